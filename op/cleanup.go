@@ -0,0 +1,106 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// deferredStep is a command registered with Rollback() or Finally(), along
+// with the working directory and environment it was registered in
+type deferredStep struct {
+	args   []string
+	dir    string
+	env    []string
+	always bool // if false, the step only runs if the Op failed
+}
+
+// Rollback registers 'args' as a command that undoes the Op's later steps.
+// It's run by Cleanup() if any step after this call fails. If the Op has
+// already failed, Rollback() does nothing (as there's nothing to undo).
+//
+// Register a rollback step before the step it undoes, so that it also runs if
+// that step fails halfway through (e.g. a 'cp -r' that runs out of space).
+func (o *Op) Rollback(args ...string) *Op {
+	if o.err == nil {
+		o.deferred = append(o.deferred, o.deferredStep(args, false))
+	}
+	return o
+}
+
+// Finally registers 'args' as a command that's run by Cleanup() whether or
+// not the Op fails
+func (o *Op) Finally(args ...string) *Op {
+	o.deferred = append(o.deferred, o.deferredStep(args, true))
+	return o
+}
+
+// deferredStep returns a deferredStep that runs 'args' in the Op's current
+// working directory and environment
+func (o *Op) deferredStep(args []string, always bool) deferredStep {
+	return deferredStep{
+		args:   args,
+		dir:    o.dir,
+		env:    append([]string(nil), o.env...),
+		always: always,
+	}
+}
+
+// Cleanup runs the Op's deferred steps in the reverse of the order they were
+// registered (like Go's 'defer'): every Finally() step, and, if the Op has
+// failed, every Rollback() step. Deferred steps run even if the Op's context
+// has been canceled, and a failed deferred step doesn't prevent the others
+// from running. Afterwards, LastError() and DetailedError() still describe the
+// Op's original failure (if any); Cleanup() returns an error describing any
+// deferred steps that failed.
+func (o *Op) Cleanup() error {
+	steps := o.deferred
+	o.deferred = nil
+	if len(steps) == 0 {
+		return nil
+	}
+
+	// Save the state describing the Op's last (possibly failed) command
+	var (
+		err, action, args = o.err, o.action, o.args
+		pipeline          = o.pipeline
+		errMsg            = append([]byte(nil), o.errMsg.Bytes()...)
+		attempts          = o.attempts
+		nsteps, stage     = o.steps, o.stage
+		exitCode, signal  = o.exitCode, o.signal
+		dir, env, ctx     = o.dir, o.env, o.ctx
+		output, journal   = o.output, o.journal
+		capture           = o.capture
+	)
+	defer func() {
+		o.err, o.action, o.args, o.attempts = err, action, args, attempts
+		o.pipeline = pipeline
+		o.steps, o.stage, o.exitCode, o.signal = nsteps, stage, exitCode, signal
+		o.errMsg.Reset()
+		o.errMsg.Write(errMsg)
+		o.dir, o.env, o.ctx = dir, env, ctx
+		o.output, o.journal, o.capture = output, journal, capture
+	}()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	o.ctx = context.WithoutCancel(ctx)
+	// Deferred steps aren't journaled, and don't capture variables
+	o.output, o.journal, o.capture = nil, nil, nil
+	var failures []string
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		if !s.always && err == nil {
+			continue
+		}
+		o.err, o.dir, o.env = nil, s.dir, s.env
+		if o.Run(s.args...) != nil {
+			failures = append(failures, o.DetailedError().Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("could not clean up:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package op
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Error describes a step of an Op that failed. It's returned by
+// DetailedError(), so callers can inspect failures with errors.As() instead
+// of parsing error messages.
+type Error struct {
+	Args []string // The failed command (or e.g. "cd <dir>")
+	Dir  string   // The working directory of the command (empty: svp's)
+
+	// Pipeline is every command in the failed step, if it was a pipeline (see
+	// Pipe()). Args is the command in it that failed.
+	Pipeline [][]string
+
+	// Step is the index of the failed step among the steps (calls to Run(),
+	// Pipe(), Do() and Chdir()) that the Op ran, starting from 0. If the step was a
+	// pipeline, Stage is the (1-based) position of the failed command in it.
+	Step  int
+	Stage int
+
+	// Action describes what the Op was doing when the step failed (e.g.
+	// "could not run command" or "command timed out")
+	Action string
+
+	// ExitCode is the failed command's exit code, or -1 if it didn't exit
+	// normally (e.g. it couldn't be started, or was killed by Signal)
+	ExitCode int
+	Signal   syscall.Signal
+
+	Stderr   []byte   // The command's stderr
+	Attempts []string // A description of each attempt, if the step was retried
+	Err      error    // The underlying error (see Unwrap())
+}
+
+func (e *Error) Error() string {
+	action := e.Action
+	if len(e.Attempts) > 1 {
+		action = fmt.Sprintf("%s after %d attempts (%s)", action,
+			len(e.Attempts), strings.Join(e.Attempts, "; "))
+	}
+	if len(e.Stderr) > 0 {
+		return fmt.Sprintf("%s (command: \"%s\"):\n%s\n(%v)", action,
+			shellCommand(e.Args), e.Stderr, e.Err)
+	}
+	return fmt.Sprintf("%s (command: \"%s\"):\n(%v)", action,
+		shellCommand(e.Args), e.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is() can match e.g.
+// ErrTimeout
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// exitStatus returns the exit code of the command that returned 'err' (0 if
+// 'err' is nil, and -1 if the command didn't exit normally), and the signal
+// that killed it (if any)
+func exitStatus(err error) (int, syscall.Signal) {
+	if err == nil {
+		return 0, 0
+	}
+	var sys interface{ Sys() interface{} }
+	if errors.As(err, &sys) {
+		if ws, ok := sys.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return -1, ws.Signal()
+		}
+	}
+	var exited interface{ ExitCode() int }
+	if errors.As(err, &exited) {
+		return exited.ExitCode(), 0
+	}
+	return -1, 0
+}
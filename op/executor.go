@@ -0,0 +1,107 @@
+package op
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Cmd describes a command for an Executor to run
+type Cmd struct {
+	Args []string
+	Dir  string   // The command's working directory (svp's, if empty)
+	Env  []string // "key=value" pairs, added to svp's environment
+
+	// The command's stdin, stdout, and stderr. Any of these may be nil. If one
+	// is an *os.File, the Executor must not use it after Start() returns
+	// (exec.Cmd, for example, passes a duplicate of the file to the process),
+	// because the Op may close it.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// If Terminal is true, the command runs in a pseudo-terminal connected to
+	// the user's terminal (see Op.Interactive()), and Stdin, Stdout, and Stderr
+	// are ignored
+	Terminal bool
+
+	// If NewProcessGroup is true, the command runs in its own process group, so
+	// that if it's killed, its children are killed with it. Such a command is
+	// in the background, so it's stopped (by SIGTTIN) if it reads from the
+	// user's terminal. Ops only set this for commands with a timeout.
+	NewProcessGroup bool
+}
+
+// Process is a command started by an Executor
+type Process interface {
+	// Wait waits for the command to exit. If the command exits with a nonzero
+	// status, the returned error should have an 'ExitCode() int' method (like
+	// *exec.ExitError)
+	Wait() error
+}
+
+// Executor starts the commands run by an Op. Ops use DefaultExecutor unless
+// they're given a different one (see Op.Executor()), so that tests can
+// replace it with a FakeExecutor.
+type Executor interface {
+	// Start starts 'c'. If 'ctx' expires before the command exits, the command
+	// should be killed.
+	Start(ctx context.Context, c *Cmd) (Process, error)
+}
+
+// DefaultExecutor is the Executor of new Ops
+var DefaultExecutor Executor = OSExecutor{}
+
+// OSExecutor is an Executor that runs commands as OS processes. By default,
+// commands run in the caller's process group, so (like commands run by a
+// shell) they can read from the user's terminal (e.g. to prompt for a
+// passphrase) and receive signals sent by it (e.g. SIGINT from Ctrl-C). If
+// the command's context expires, only the command itself is killed.
+//
+// Commands with Cmd.NewProcessGroup set run in their own process group
+// instead, so that if their context expires, the command and all of its
+// children are killed together. They don't receive signals sent by the
+// terminal, so programs using Op should cancel the Op's context when
+// interrupted.
+type OSExecutor struct {
+	// TTY is the path of the user's terminal, to which commands run with
+	// Cmd.Terminal are connected (by default, /dev/tty)
+	TTY string
+}
+
+// Start implements the Executor interface
+func (e OSExecutor) Start(ctx context.Context, c *Cmd) (Process, error) {
+	if c.Terminal {
+		tty := e.TTY
+		if tty == "" {
+			tty = "/dev/tty"
+		}
+		return startTerminal(ctx, tty, c)
+	}
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = c.Stdin, c.Stdout, c.Stderr
+	if c.NewProcessGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			// Kill the whole process group (negative pid), not just the command
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	cmd.WaitDelay = waitDelay
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// Executor directs 'o' to run subsequent commands with 'e'
+func (o *Op) Executor(e Executor) *Op {
+	o.executor = e
+	return o
+}
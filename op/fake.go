@@ -0,0 +1,223 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FakeExecutor is an Executor for tests. Instead of running commands, it
+// checks each one against the next command in a script of expected commands
+// (see Expect()) and returns that command's canned output and exit code.
+// Once the code under test has finished, Verify() reports any unexpected
+// commands and any expected commands that weren't run.
+type FakeExecutor struct {
+	mu       sync.Mutex
+	expected []*Expectation
+	next     int     // index of the next expected command
+	errs     []error // mismatches, reported by Verify()
+}
+
+// TestingT is the part of testing.TB that UseFakeExecutor() uses. It's
+// declared here so that op doesn't import "testing", which would link the
+// testing package (and its flags) into every program that uses op.
+type TestingT interface {
+	Cleanup(func())
+	Helper()
+	Error(args ...interface{})
+}
+
+// UseFakeExecutor replaces DefaultExecutor with a new FakeExecutor for the
+// rest of the test 't'. When the test finishes, the previous DefaultExecutor
+// is restored, and the test fails if Verify() reports any problems.
+func UseFakeExecutor(t TestingT) *FakeExecutor {
+	t.Helper()
+	fake := &FakeExecutor{}
+	prev := DefaultExecutor
+	DefaultExecutor = fake
+	t.Cleanup(func() {
+		DefaultExecutor = prev
+		if err := fake.Verify(); err != nil {
+			t.Error(err)
+		}
+	})
+	return fake
+}
+
+// Expectation is a command expected by a FakeExecutor, and its canned result
+type Expectation struct {
+	args     []string
+	dir      *string
+	stdout   string
+	stderr   string
+	exitCode int
+	do       func(c *Cmd)
+
+	// Stdin is set to everything the command read from its stdin, once the
+	// command has run
+	Stdin string
+}
+
+// ExitError is returned by a FakeExecutor's processes for commands that exit
+// with a nonzero status
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code of the fake command (like
+// exec.ExitError.ExitCode())
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Expect adds a command with the arguments 'args' to the end of the script of
+// expected commands. By default, the command succeeds and prints nothing.
+func (f *FakeExecutor) Expect(args ...string) *Expectation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := &Expectation{args: args}
+	f.expected = append(f.expected, e)
+	return e
+}
+
+// InDir directs the FakeExecutor to check that the command runs in 'dir'
+func (e *Expectation) InDir(dir string) *Expectation {
+	e.dir = &dir
+	return e
+}
+
+// Returns sets the stdout of the command
+func (e *Expectation) Returns(stdout string) *Expectation {
+	e.stdout = stdout
+	return e
+}
+
+// Fails makes the command print 'stderr' and exit with 'exitCode'
+func (e *Expectation) Fails(exitCode int, stderr string) *Expectation {
+	e.exitCode, e.stderr = exitCode, stderr
+	return e
+}
+
+// Do directs the FakeExecutor to call 'f' when the command runs (e.g. to
+// create files that the real command would have created)
+func (e *Expectation) Do(f func(c *Cmd)) *Expectation {
+	e.do = f
+	return e
+}
+
+// Verify returns an error describing every command that didn't match the
+// script, and every expected command that wasn't run
+func (f *FakeExecutor) Verify() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	errs := f.errs
+	for _, e := range f.expected[f.next:] {
+		errs = append(errs, fmt.Errorf("expected command was not run: %s",
+			shellCommand(e.args)))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+// Start implements the Executor interface
+func (f *FakeExecutor) Start(ctx context.Context, c *Cmd) (Process, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.next >= len(f.expected) {
+		err := fmt.Errorf("unexpected command: %s", shellCommand(c.Args))
+		f.errs = append(f.errs, err)
+		return nil, err
+	}
+	e := f.expected[f.next]
+	var err error
+	if shellCommand(e.args) != shellCommand(c.Args) {
+		err = fmt.Errorf("expected command %s, but got: %s",
+			shellCommand(e.args), shellCommand(c.Args))
+		f.errs = append(f.errs, err)
+		return nil, err
+	}
+	f.next++
+	if e.dir != nil && *e.dir != c.Dir {
+		f.errs = append(f.errs, fmt.Errorf("expected %s to run in %q, but it ran "+
+			"in %q", shellCommand(c.Args), *e.dir, c.Dir))
+	}
+
+	// Like a real process, use duplicates of any files in 'c'
+	stdin, stdout := c.Stdin, c.Stdout
+	if f, ok := stdin.(*os.File); ok {
+		if stdin, err = dup(f); err != nil {
+			return nil, err
+		}
+	}
+	if f, ok := stdout.(*os.File); ok {
+		if stdout, err = dup(f); err != nil {
+			return nil, err
+		}
+	}
+	p := &fakeProcess{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		if stdin != nil {
+			in, _ := ioutil.ReadAll(stdin)
+			e.Stdin = string(in)
+			closeIfFile(stdin)
+		}
+		if e.do != nil {
+			e.do(c)
+		}
+		if stdout != nil {
+			io.WriteString(stdout, e.stdout)
+			closeIfFile(stdout)
+		}
+		if c.Stderr != nil {
+			io.WriteString(c.Stderr, e.stderr)
+		}
+		if e.exitCode != 0 {
+			p.err = &ExitError{Code: e.exitCode}
+		}
+	}()
+	return p, nil
+}
+
+// fakeProcess is a Process started by a FakeExecutor
+type fakeProcess struct {
+	done chan struct{}
+	err  error
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// dup returns a duplicate of 'f', which can be used (and closed) after 'f'
+// is closed
+func dup(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("could not duplicate %s: %v", f.Name(), err)
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// closeIfFile closes 'v' if it's a file (i.e. one created by dup())
+func closeIfFile(v interface{}) {
+	if f, ok := v.(*os.File); ok {
+		f.Close()
+	}
+}
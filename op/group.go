@@ -0,0 +1,187 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Group runs independent sequences of commands concurrently, each in its own
+// Op, and collects all of their results. For example:
+//
+//	g := op.NewGroup(ctx, 4)
+//	for _, repo := range repos {
+//	  g.Run(repo, "git", "-C", repo, "fetch")
+//	}
+//	err := g.Wait() // lists every repo that couldn't be fetched
+type Group struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	start    func() *Op
+	sem      chan struct{} // limits parallelism; nil if unlimited
+	failFast bool
+
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	results []Result
+}
+
+// Result is the outcome of one task in a Group
+type Result struct {
+	Name   string
+	Output string // The stdout of the task's last command, if collected
+	Err    error
+}
+
+// GroupError is returned by Group.Wait() if any of the group's tasks failed
+type GroupError struct {
+	Total    int      // The number of tasks in the group
+	Failed   []Result // The tasks that failed, in the order they were added
+	Canceled int      // The number of tasks that were canceled
+
+	canceled []error // The errors of the canceled tasks (see Unwrap())
+}
+
+func (e *GroupError) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d of %d commands failed", len(e.Failed), e.Total)
+	if e.Canceled > 0 {
+		fmt.Fprintf(&buf, " (%d canceled)", e.Canceled)
+	}
+	for _, r := range e.Failed {
+		msg := strings.Replace(r.Err.Error(), "\n", "\n  ", -1)
+		fmt.Fprintf(&buf, "\n[%s] %s", r.Name, msg)
+	}
+	return buf.String()
+}
+
+// Unwrap returns the errors of the failed tasks, followed by those of the
+// canceled tasks, so that errors.Is() and errors.As() can match them (e.g.
+// errors.Is(err, ErrCanceled) is true if any task was canceled)
+func (e *GroupError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed)+len(e.canceled))
+	for _, r := range e.Failed {
+		errs = append(errs, r.Err)
+	}
+	return append(errs, e.canceled...)
+}
+
+// NewGroup creates a Group that runs at most 'parallelism' tasks at once (or
+// any number of tasks, if 'parallelism' is 0). If 'ctx' is canceled, running
+// tasks are killed and no new tasks are started.
+func NewGroup(ctx context.Context, parallelism int) *Group {
+	g := &Group{start: StartOp}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	if parallelism > 0 {
+		g.sem = make(chan struct{}, parallelism)
+	}
+	return g
+}
+
+// StartOpWith directs 'g' to create the Op for each task with 'start' (e.g. to
+// configure dry-run mode or a retry policy). The Op's context is replaced with
+// the group's.
+func (g *Group) StartOpWith(start func() *Op) *Group {
+	g.start = start
+	return g
+}
+
+// CancelOnFailure directs 'g' to cancel all of its remaining tasks (killing
+// any running commands) as soon as one task fails
+func (g *Group) CancelOnFailure() *Group {
+	g.failFast = true
+	return g
+}
+
+// Go runs 'f' concurrently with the group's other tasks, passing it a new Op.
+// 'name' identifies the task in the group's results and errors. If the group
+// is already running as many tasks as it's allowed to, Go() blocks until one
+// of them finishes (so tasks start in the order they're added).
+func (g *Group) Go(name string, f func(o *Op) error) {
+	g.mu.Lock()
+	i := len(g.results)
+	g.results = append(g.results, Result{Name: name})
+	g.mu.Unlock()
+
+	// Wait for a free slot
+	acquired := false
+	if g.sem != nil {
+		select {
+		case g.sem <- struct{}{}:
+			acquired = true
+		case <-g.ctx.Done():
+		}
+	}
+	release := func() {
+		if acquired {
+			<-g.sem
+		}
+	}
+	if g.ctx.Err() != nil {
+		release()
+		g.finish(i, "", fmt.Errorf("%w (before it started)", ErrCanceled))
+		return
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer release()
+		o := g.start()
+		o.ctx = g.ctx
+		err := f(o)
+		g.finish(i, o.Output(), err)
+	}()
+}
+
+// finish records the result of the 'i'th task
+func (g *Group) finish(i int, output string, err error) {
+	if err != nil && g.failFast {
+		g.cancel()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.results[i].Output, g.results[i].Err = output, err
+}
+
+// Run runs the command 'args' concurrently with the group's other tasks, and
+// collects its stdout (see Results())
+func (g *Group) Run(name string, args ...string) {
+	g.Go(name, func(o *Op) error {
+		o.CollectStdOut()
+		o.Run(args...)
+		return o.DetailedError()
+	})
+}
+
+// Wait waits for all of the group's tasks to finish. If any failed (or were
+// canceled), it returns a *GroupError describing all of them.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	e := &GroupError{Total: len(g.results)}
+	for _, r := range g.results {
+		switch {
+		case r.Err == nil:
+		case errors.Is(r.Err, ErrCanceled):
+			e.Canceled++
+			e.canceled = append(e.canceled, r.Err)
+		default:
+			e.Failed = append(e.Failed, r)
+		}
+	}
+	if len(e.Failed) == 0 && e.Canceled == 0 {
+		return nil
+	}
+	return e
+}
+
+// Results returns the result of each of the group's tasks, in the order they
+// were added. It should be called after Wait().
+func (g *Group) Results() []Result {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Result(nil), g.results...)
+}
@@ -0,0 +1,200 @@
+package op
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// journalEntry describes a step that an Op finished, in its journal file
+type journalEntry struct {
+	ID     string   `json:"id"`
+	Args   []string `json:"args,omitempty"`
+	Dir    string   `json:"dir,omitempty"`
+	Output string   `json:"output,omitempty"` // the step's stdout, if collected
+
+	// The variables captured (see Capture()) or set (by Do()) by the step
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// String describes the step as its ID and command (steps run by Do() have no
+// command)
+func (e journalEntry) String() string {
+	if len(e.Args) == 0 {
+		return e.ID
+	}
+	return fmt.Sprintf("%s (%s)", e.ID, shellCommand(e.Args))
+}
+
+// journal tracks the steps of an Op that have finished (in this run, or a
+// previous run of the same Op), so that a re-run can skip them
+type journal struct {
+	path    string
+	log     io.Writer      // warnings and 'skipping' messages are written here
+	entries []journalEntry // finished steps
+	next    int            // the index of the Op's next step
+}
+
+// Journal directs 'o' to record each step that it finishes (each call to
+// Run(), Pipe() or Do()) in the journal file at 'path', and to skip steps
+// that were recorded there by a previous run of the same Op. Skipped steps
+// succeed immediately, Output() returns the output they collected when they
+// ran, and the variables they captured (see Capture()) are restored.
+//
+// Steps are identified by their position in the Op, or by StepID(). If a step
+// doesn't match the journal (i.e. the Op's commands changed since the journal
+// was written), a warning is written to 'log' (if set), and that step and all
+// later steps are run again.
+//
+// Call DiscardJournal() once the Op has finished, so that the next run starts
+// from the beginning.
+func (o *Op) Journal(path string, log io.Writer) *Op {
+	if log == nil {
+		log = ioutil.Discard
+	}
+	j := &journal{path: path, log: log}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		o.action, o.err = "could not read journal "+path, err
+		return o
+	}
+	for s := bufio.NewScanner(bytes.NewReader(contents)); s.Scan(); {
+		var e journalEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			o.action, o.err = "could not parse journal "+path, err
+			return o
+		}
+		j.entries = append(j.entries, e)
+	}
+	o.journal = j
+	return o
+}
+
+// StepID sets the ID of the Op's next step in its journal (see Journal()).
+// Step IDs make mismatches between the Op and its journal easier to
+// understand.
+func (o *Op) StepID(id string) *Op {
+	o.stepID = id
+	return o
+}
+
+// DiscardJournal deletes the Op's journal file (e.g. after the Op succeeds)
+func (o *Op) DiscardJournal() error {
+	if o.journal == nil || o.dryRun {
+		return nil
+	}
+	if err := os.Remove(o.journal.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove journal %s: %v", o.journal.path, err)
+	}
+	return nil
+}
+
+// beginJournalStep assigns the next step (which runs the Op's current
+// command) an ID. If that step was already finished by a previous run, it
+// restores the step's output and returns true (meaning the step should be
+// skipped).
+func (o *Op) beginJournalStep() (entry journalEntry, skip bool) {
+	id := o.stepID
+	o.stepID = ""
+	if o.journal == nil {
+		return journalEntry{}, false
+	}
+	j := o.journal
+	if id == "" {
+		id = strconv.Itoa(j.next + 1)
+	}
+	entry = journalEntry{ID: id, Args: o.args, Dir: o.dir}
+	i := j.next
+	j.next++
+	if i >= len(j.entries) {
+		return entry, false // this step hasn't run yet
+	}
+	prev := j.entries[i]
+	if prev.ID == entry.ID && prev.Dir == entry.Dir &&
+		shellCommand(prev.Args) == shellCommand(entry.Args) {
+		fmt.Fprintf(j.log, "skipping step %s, which finished in a previous "+
+			"run\n", entry)
+		if len(entry.Args) > 0 {
+			o.record("# already done: " + shellCommand(entry.Args))
+		}
+		if buf, ok := o.output.(*bytes.Buffer); ok {
+			buf.WriteString(prev.Output)
+		}
+		for name, value := range prev.Vars {
+			o.SetVar(name, value)
+		}
+		return entry, true
+	}
+
+	// The Op has changed since the journal was written, so its remaining
+	// entries can't be trusted
+	fmt.Fprintf(j.log, "warning: step %s is now \"%s\" (in %q), but journal %s "+
+		"recorded step %s as \"%s\" (in %q); re-running it and all later steps\n",
+		id, shellCommand(entry.Args), entry.Dir, j.path, prev.ID,
+		shellCommand(prev.Args), prev.Dir)
+	j.entries = j.entries[:i]
+	if err := j.rewrite(o.dryRun); err != nil {
+		fmt.Fprintf(j.log, "warning: %v\n", err)
+	}
+	return entry, false
+}
+
+// endJournalStep records 'entry' (a step that just succeeded) in the Op's
+// journal
+func (o *Op) endJournalStep(entry journalEntry) error {
+	if o.journal == nil {
+		return nil
+	}
+	j := o.journal
+	entry.Output = o.Output()
+	j.entries = append(j.entries, entry)
+	if o.dryRun {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		o.action, o.err = "could not serialize journal entry", err
+		return o.err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		o.action, o.err = "could not create journal directory", err
+		return o.err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		o.action, o.err = "could not write journal "+j.path, err
+		return o.err
+	}
+	return nil
+}
+
+// rewrite replaces the journal file with 'j.entries'
+func (j *journal) rewrite(dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range j.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("could not serialize journal entry: %v", err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if err := ioutil.WriteFile(j.path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not rewrite journal %s: %v", j.path, err)
+	}
+	return nil
+}
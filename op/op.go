@@ -2,11 +2,33 @@ package op
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
-	"strings"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// waitDelay is how long Run() waits for a killed command's output to be
+// closed (e.g. by grandchildren that were not killed) before giving up on it
+const waitDelay = 5 * time.Second
+
+var (
+	// ErrTimeout is returned (wrapped) by Run() if a command was killed because
+	// it ran for longer than the Op's timeout
+	ErrTimeout = errors.New("command timed out")
+
+	// ErrCanceled is returned (wrapped) by Run() if a command was killed
+	// because the Op's context was canceled
+	ErrCanceled = errors.New("command was canceled")
+
+	// ErrUndefinedVariable is returned (wrapped) by Run() and Pipe() if a
+	// command refers to a variable that hasn't been set (see ExpandVars())
+	ErrUndefinedVariable = errors.New("undefined variable")
 )
 
 // Op tracks internal state of a sequence of bash commands that is intended to
@@ -14,16 +36,102 @@ import (
 type Op struct {
 	args []string // The last command (updated after each call to Run())
 
+	// The commands in the last step, if it was a pipeline (see Pipe()). If the
+	// pipeline failed, 'args' is the stage that failed.
+	pipeline [][]string
+
 	action string       // Updated as we run the command, for reporting errors
 	err    error        // The error oject returned by exec.Command (or some such)
 	errMsg bytes.Buffer // The text written by the last command to stderr
 	output io.Writer    // The text written by the last command to stdout (if set)
 	input  io.Reader    // The text read as input
+
+	// Extra destinations for commands' stdout and stderr (see TeeStdOut())
+	stdoutTees  []io.Writer
+	stderrTees  []io.Writer
+	prefixLines bool
+	prefixLabel string
+
+	// If true, commands run in a pseudo-terminal (see Interactive())
+	interactive bool
+
+	// Variables that steps' arguments can refer to (if 'expandVars' is set;
+	// see ExpandVars()), and the variable that the next step sets (if any).
+	// Variables captured in dry-run mode have no value, but are recorded in
+	// 'dryRunVars'.
+	expandVars bool
+	vars       map[string]string
+	dryRunVars map[string]bool
+	capture    *capture
+
+	// The resources used by each step (see Usage())
+	usage          []Usage
+	usageObservers []func(Usage)
+
+	// The working directory and environment variables of subsequent commands.
+	// These are scoped to the Op (rather than the svp process), so that
+	// several Ops can run at once. If 'dir' is empty, commands run in svp's
+	// working directory.
+	dir string
+	env []string // "key=value" pairs, added to svp's environment
+
+	ctx      context.Context // If canceled, running commands are killed
+	timeout  time.Duration   // Max duration of each command (if nonzero)
+	executor Executor        // Runs the Op's commands
+	retry    RetryPolicy     // Which failed commands to retry (see Retry())
+
+	// The Op's journal, if any (see Journal()), and the ID of its next step
+	journal *journal
+	stepID  string
+
+	// A description of each failed attempt to run the last command, if it was
+	// retried
+	attempts []string
+
+	// The number of steps the Op has started, and the exit status of the last
+	// one (see Error)
+	steps    int
+	stage    int
+	exitCode int
+	signal   syscall.Signal
+
+	// Steps to run after the Op finishes (see Rollback() and Finally())
+	deferred []deferredStep
+
+	// Every command that the Op has run (or would have run, in dry-run mode),
+	// as lines of bash (see Script())
+	script    []string
+	dryRun    bool
+	dryRunOut io.Writer // If set, dry-run commands are printed here
+
+	// A record of each step run by the Op (see RecordTranscript())
+	transcribe       bool
+	transcribeStdout bool // see TranscribeStdout()
+	transcript       []TranscriptEntry
+	observers        []func(TranscriptEntry)
 }
 
 // StartOp creates and initializes a new Op
 func StartOp() *Op {
-	return &Op{}
+	return StartOpWithContext(context.Background())
+}
+
+// StartOpWithContext creates and initializes a new Op. If 'ctx' is canceled,
+// any command that the Op is running is killed and no further commands are
+// run.
+func StartOpWithContext(ctx context.Context) *Op {
+	return &Op{ctx: ctx, executor: DefaultExecutor}
+}
+
+// Timeout directs 'o' to kill subsequent commands (and all of their children)
+// if they run for longer than 'd'. If 'd' is 0, commands may run indefinitely.
+//
+// Commands with a timeout run in their own process group (see
+// Cmd.NewProcessGroup), so they can't read from the user's terminal unless
+// they're run with Interactive().
+func (o *Op) Timeout(d time.Duration) *Op {
+	o.timeout = d
+	return o
 }
 
 // LastError returns any errors produced during a Run() call (i.e. the error
@@ -42,17 +150,25 @@ func (o *Op) LastErrorMsg() []byte {
 }
 
 // DetailedError is similar to LastError(), but it produces a more detailed
-// error message
+// error message. The error is an *Error (which wraps LastError()), so callers
+// can inspect the failed step with errors.As().
 func (o *Op) DetailedError() error {
 	if o.err == nil {
 		return nil
 	}
-	if o.errMsg.Len() > 0 {
-		return fmt.Errorf("%s (command: \"%s\"):\n%s\n(%s)", o.action,
-			strings.Join(o.args, " "), o.errMsg.Bytes(), o.err.Error())
+	return &Error{
+		Args:     o.args,
+		Pipeline: o.pipeline,
+		Dir:      o.dir,
+		Step:     o.steps - 1,
+		Stage:    o.stage,
+		Action:   o.action,
+		ExitCode: o.exitCode,
+		Signal:   o.signal,
+		Stderr:   append([]byte(nil), o.errMsg.Bytes()...),
+		Attempts: o.attempts,
+		Err:      o.err,
 	}
-	return fmt.Errorf("%s (command: \"%s\"):\n(%s)", o.action,
-		strings.Join(o.args, " "), o.err.Error())
 }
 
 // CollectStdOut directs 'o' to collect the output (from stdout) of commands it
@@ -84,16 +200,60 @@ func (o *Op) InputFrom(r io.Reader) *Op {
 	return o
 }
 
+// Dir sets the working directory of subsequent commands run by 'o' (without
+// affecting the working directory of svp itself). Relative paths are resolved
+// against the Op's current directory. Unlike Chdir(), this doesn't check that
+// 'dest' exists.
+func (o *Op) Dir(dest string) *Op {
+	o.record("cd " + shellQuote(dest))
+	o.dir = o.resolve(dest)
+	return o
+}
+
+// Setenv sets the environment variable 'key' to 'value' for subsequent
+// commands run by 'o' (without affecting the environment of svp itself)
+func (o *Op) Setenv(key, value string) *Op {
+	o.record("export " + key + "=" + shellQuote(value))
+	o.env = append(o.env, key+"="+value)
+	return o
+}
+
+// resolve returns 'p' relative to the Op's working directory
+func (o *Op) resolve(p string) string {
+	if filepath.IsAbs(p) || o.dir == "" {
+		return p
+	}
+	return filepath.Join(o.dir, p)
+}
+
+// Chdir changes the working directory of subsequent commands run by 'o' to
+// 'dest' (assuming no previous commands have failed), like 'cd' in a bash
+// script. Only the Op's working directory changes; svp's doesn't.
 func (o *Op) Chdir(dest string) error {
 	// Only run while the whole Op is still successful
 	if o.err != nil {
 		return o.err
 	}
+	o.beginStepStatus()
 	o.args = []string{"cd", dest}
-	if o.err = os.Chdir(dest); o.err != nil {
+	o.record(shellCommand(o.args))
+	dest = o.resolve(dest)
+	if o.dryRun {
+		o.dir = dest // 'dest' may be created by an earlier (unrun) command
+		return nil
+	}
+	trace := o.beginStep(o.args)
+	info, err := os.Stat(dest)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dest)
+	}
+	o.endStep(trace, nil, err)
+	if o.err = err; o.err != nil {
 		o.action = "could not change directory"
+		return o.err
 	}
-	return o.err
+	o.dir = dest
+	return nil
 }
 
 // Run runs a command (assuming no previous commands have failed). It returns
@@ -105,28 +265,182 @@ func (o *Op) Run(inputargs ...string) error {
 	if o.err != nil {
 		return o.err
 	}
-	// Prepare buffers for next command
+	o.resetBuffers()
+	o.beginStepStatus()
+	o.args = inputargs
+	c := o.takeCapture()
+	args, line, err := o.expand(inputargs)
+	if err != nil {
+		o.action, o.err = "could not expand arguments", err
+		return o.err
+	}
+	o.args = args
+	step, skip := o.beginJournalStep()
+	if skip {
+		return nil
+	}
+	o.record(c.scriptLine(line))
+	if o.dryRun {
+		o.dryRunCapture(c)
+		return o.endJournalStep(step)
+	}
+
+	// If the command may be retried, save its input so it can be re-read
+	input := func() io.Reader { return o.input }
+	if o.retry.MaxAttempts > 1 && o.input != nil {
+		buf, err := ioutil.ReadAll(o.input)
+		if err != nil {
+			o.action, o.err = "could not read command input", err
+			return o.err
+		}
+		input = func() io.Reader { return bytes.NewReader(buf) }
+	}
+	for attempt := 1; ; attempt++ {
+		if o.runOnce(input(), c) == nil {
+			if o.endCapture(c, &step) != nil {
+				return o.err
+			}
+			return o.endJournalStep(step)
+		}
+		if o.retry.MaxAttempts > 1 {
+			o.attempts = append(o.attempts, describeAttempt(attempt, o.err,
+				o.errMsg.Bytes()))
+		}
+		if !o.retry.shouldRetry(attempt, o.err, o.errMsg.Bytes()) {
+			return o.err
+		}
+		select {
+		case <-time.After(o.retry.backoff(attempt)):
+		case <-o.ctx.Done():
+			o.action = "command was canceled"
+			o.err = fmt.Errorf("%w (while waiting to retry: %v)", ErrCanceled, o.err)
+			return o.err
+		}
+		o.err = nil
+		o.resetBuffers()
+	}
+}
+
+// Do runs 'f' as a step of the Op (assuming no previous steps have failed),
+// for steps that aren't a single command: e.g. a check, or a step that runs
+// its own Ops. Like Run(), the step is recorded in the Op's journal (give it
+// an ID with StepID()), so a re-run skips it once 'f' has succeeded, and the
+// variables that 'f' sets with SetVar() are restored. 'f' runs even in dry-run
+// mode, so it should dry-run any commands it runs. If 'f' fails, its error
+// becomes the Op's error, which Do() returns.
+func (o *Op) Do(f func() error) error {
+	if o.err != nil {
+		return o.err
+	}
+	o.resetBuffers()
+	o.beginStepStatus()
+	o.args = nil
+	step, skip := o.beginJournalStep()
+	if skip {
+		return nil
+	}
+	prev := make(map[string]string, len(o.vars))
+	for name, value := range o.vars {
+		prev[name] = value
+	}
+	if err := f(); err != nil {
+		o.action, o.err = "step failed", err
+		return o.err
+	}
+	for name, value := range o.vars {
+		if old, ok := prev[name]; !ok || old != value {
+			if step.Vars == nil {
+				step.Vars = make(map[string]string)
+			}
+			step.Vars[name] = value
+		}
+	}
+	return o.endJournalStep(step)
+}
+
+// runOnce runs the Op's current command once, reading its stdin from 'input'
+// (and capturing its stdout into 'c', if set)
+func (o *Op) runOnce(input io.Reader, c *capture) error {
+	ctx, cancel := o.cmdContext()
+	defer cancel()
+	cmd := o.command(o.args)
+	cmd.Stdin = input
+	cmd.Terminal = o.interactive
+	trace := o.beginStep(o.args)
+	if trace != nil && o.retry.MaxAttempts > 1 {
+		trace.entry.Attempt = len(o.attempts) + 1
+	}
+	var flushStdout, flushStderr func()
+	cmd.Stdout, flushStdout = o.tee(o.args,
+		c.stdoutFor(trace.stdoutFor(o.output)), o.stdoutTees)
+	cmd.Stderr, flushStderr = o.tee(o.args, &o.errMsg, o.stderrTees)
+	start := time.Now()
+	p, err := o.executor.Start(ctx, cmd)
+	if err == nil {
+		err = p.Wait()
+	}
+	flushStdout()
+	flushStderr()
+	o.recordUsage(trace, o.args, start, p)
+	o.endStep(trace, o.errMsg.Bytes(), err)
+	o.exitCode, o.signal = exitStatus(err)
+	o.action, o.err = o.cmdError(ctx, err)
+	return o.err
+}
+
+// beginStepStatus resets the Op's record of the last step's status, before it
+// starts a new step
+func (o *Op) beginStepStatus() {
+	o.steps++
+	o.stage, o.exitCode, o.signal = 0, -1, 0
+	o.pipeline = nil
+	o.attempts = nil
+}
+
+// resetBuffers prepares the Op's stderr and stdout buffers for the next
+// command
+func (o *Op) resetBuffers() {
 	o.errMsg.Reset()
 	if o.output != nil {
 		if buf, ok := o.output.(*bytes.Buffer); ok {
 			buf.Reset()
-		} else {
-			buf = nil
 		}
 	}
+}
 
-	// Create new exec.Command
-	o.args = inputargs
-	cmd := exec.Command(o.args[0], o.args[1:]...)
-	cmd.Stderr = &o.errMsg
-	if o.input != nil {
-		cmd.Stdin = o.input
+// cmdContext returns the context for the next command run by 'o', which
+// expires after the Op's timeout (if set)
+func (o *Op) cmdContext() (context.Context, context.CancelFunc) {
+	if o.ctx == nil {
+		o.ctx = context.Background()
 	}
-	if o.output != nil {
-		cmd.Stdout = o.output
+	if o.timeout > 0 {
+		return context.WithTimeout(o.ctx, o.timeout)
+	}
+	return context.WithCancel(o.ctx)
+}
+
+// command returns a Cmd that runs 'args' in the Op's working directory and
+// environment
+func (o *Op) command(args []string) *Cmd {
+	return &Cmd{Args: args, Dir: o.dir, Env: o.env,
+		NewProcessGroup: o.timeout > 0}
+}
+
+// cmdError converts the error returned by running a command with the context
+// 'ctx' into the action and error that the Op reports, distinguishing
+// commands that were killed by a timeout or cancellation from commands that
+// failed on their own
+func (o *Op) cmdError(ctx context.Context, err error) (string, error) {
+	if err == nil {
+		return "", nil
 	}
-	if o.err = cmd.Run(); o.err != nil {
-		o.action = "could not run command"
+	switch {
+	case o.ctx.Err() != nil:
+		return "command was canceled", fmt.Errorf("%w (%v)", ErrCanceled, err)
+	case ctx.Err() == context.DeadlineExceeded:
+		return "command timed out", fmt.Errorf("%w after %v (%v)", ErrTimeout,
+			o.timeout, err)
 	}
-	return o.err
+	return "could not run command", err
 }
@@ -0,0 +1,967 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChdirIsOpScoped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("could not get working directory: %v", err)
+	}
+
+	o := StartOp()
+	o.CollectStdOut()
+	o.Chdir(dir)
+	o.Run("pwd")
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(o.Output()); got != dir {
+		t.Fatalf("expected command to run in %s, but ran in %s", dir, got)
+	}
+	if wd2, _ := os.Getwd(); wd2 != wd {
+		t.Fatalf("Op.Chdir changed the process's working directory to %s", wd2)
+	}
+}
+
+func TestChdirMissingDir(t *testing.T) {
+	o := StartOp()
+	if err := o.Chdir("/does/not/exist"); err == nil {
+		t.Fatal("expected error from Chdir to a missing directory, but got nil")
+	}
+	// Commands after a failed Chdir must not run
+	if err := o.Run("true"); err == nil {
+		t.Fatal("expected Run to return Chdir's error, but got nil")
+	}
+}
+
+func TestSetenv(t *testing.T) {
+	o := StartOp()
+	o.CollectStdOut()
+	o.Setenv("OP_TEST_VAR", "value")
+	o.Run("sh", "-c", "echo $OP_TEST_VAR")
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(o.Output()); got != "value" {
+		t.Fatalf("expected OP_TEST_VAR=value, but got %q", got)
+	}
+	if _, ok := os.LookupEnv("OP_TEST_VAR"); ok {
+		t.Fatal("Op.Setenv changed the process's environment")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	o := StartOp()
+	o.Timeout(100 * time.Millisecond)
+	start := time.Now()
+	// The timeout must kill the sleep (a grandchild), not just the shell
+	o.Run("sh", "-c", "sleep 10; true")
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("command was not killed by timeout (ran for %v)", d)
+	}
+	if !errors.Is(o.LastError(), ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, but got %v", o.LastError())
+	}
+	if err := o.DetailedError(); !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected DetailedError to report a timeout, but got %v", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	o := StartOpWithContext(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	o.Run("sleep", "10")
+	if !errors.Is(o.LastError(), ErrCanceled) {
+		t.Fatalf("expected ErrCanceled, but got %v", o.LastError())
+	}
+	// No further commands should run
+	if err := o.Run("true"); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("expected Run after cancellation to fail, but got %v", err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	o := StartOp()
+	o.CollectStdOut()
+	o.InputFrom(strings.NewReader("b\na\nb\nc\n"))
+	o.Pipe([]string{"cat"}, []string{"grep", "-v", "c"}, []string{"sort", "-u"})
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if got := o.Output(); got != "a\nb\n" {
+		t.Fatalf("expected \"a\\nb\\n\", but got %q", got)
+	}
+}
+
+func TestPipeFail(t *testing.T) {
+	o := StartOp()
+	o.CollectStdOut()
+	o.Pipe([]string{"sh", "-c", "echo oops >&2; exit 3"}, []string{"cat"})
+	err := o.DetailedError()
+	if err == nil {
+		t.Fatal("expected pipeline to fail, but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "stage 1 of 2") ||
+		!strings.Contains(err.Error(), "oops") {
+		t.Fatalf("expected error to identify stage 1 and its stderr, but got: %v",
+			err)
+	}
+	if string(o.LastErrorMsg()) != "oops" {
+		t.Fatalf("expected LastErrorMsg() to be \"oops\", but got %q",
+			o.LastErrorMsg())
+	}
+}
+
+func TestPipeMissingCommand(t *testing.T) {
+	o := StartOp()
+	o.Pipe([]string{"echo", "hi"}, []string{"/does/not/exist"})
+	if err := o.DetailedError(); err == nil ||
+		!strings.Contains(err.Error(), "stage 2 of 2") {
+		t.Fatalf("expected error in stage 2, but got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	var printed bytes.Buffer
+	o := StartOp()
+	o.DryRun(&printed)
+	o.Setenv("GOPATH", "/home/me/go path")
+	o.Chdir(filepath.Join(dir, "not-created-yet"))
+	o.Run("touch", marker)
+	o.Run("echo", "it's")
+	o.Pipe([]string{"git", "log"}, []string{"grep", "-v", "a b"})
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("dry-run Op ran a command (%s exists)", marker)
+	}
+	want := "export GOPATH='/home/me/go path'\n" +
+		"cd " + filepath.Join(dir, "not-created-yet") + "\n" +
+		"touch " + marker + "\n" +
+		"echo 'it'\\''s'\n" +
+		"git log | grep -v 'a b'\n"
+	if printed.String() != want {
+		t.Fatalf("expected dry-run output:\n%s\nbut got:\n%s", want, printed.String())
+	}
+	if script := o.Script(); !strings.HasSuffix(script, want) ||
+		!strings.HasPrefix(script, "#!/bin/bash\n") {
+		t.Fatalf("unexpected script:\n%s", script)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	var observed []TranscriptEntry
+	var logged bytes.Buffer
+	o := StartOp()
+	o.RecordTranscript(func(e TranscriptEntry) {
+		observed = append(observed, e)
+	}, JSONLines(&logged))
+	o.Chdir("/")
+	o.CollectStdOut()
+	o.Run("sh", "-c", "echo quiet; echo err >&2")
+	o.TranscribeStdout()
+	o.Run("sh", "-c", "echo out; echo err >&2")
+	o.Pipe([]string{"echo", "hi"}, []string{"sh", "-c", "cat; exit 4"})
+
+	entries := o.Transcript()
+	if len(entries) != 4 || len(observed) != 4 {
+		t.Fatalf("expected 4 transcript entries, but got %d (observed %d)",
+			len(entries), len(observed))
+	}
+	// stdout is only recorded after TranscribeStdout()
+	if e := entries[1]; e.Stdout != "" || e.Stderr != "err\n" {
+		t.Fatalf("unexpected transcript entry for 'sh' before "+
+			"TranscribeStdout(): %+v", e)
+	}
+	entries = entries[1:]
+	if e := entries[1]; e.Dir != "/" || e.ExitCode != 0 || e.Stdout != "out\n" ||
+		e.Stderr != "err\n" || e.Start.IsZero() {
+		t.Fatalf("unexpected transcript entry for 'sh': %+v", e)
+	}
+	if e := entries[2]; e.ExitCode != 4 || e.Stdout != "hi\n" ||
+		e.Args[0] != "echo" {
+		t.Fatalf("unexpected transcript entry for pipeline: %+v", e)
+	}
+	if lines := strings.Count(logged.String(), "\n"); lines != 4 {
+		t.Fatalf("expected 4 lines of JSON, but got %d:\n%s", lines,
+			logged.String())
+	}
+}
+
+func TestTranscriptTruncation(t *testing.T) {
+	o := StartOp()
+	o.RecordTranscript().TranscribeStdout()
+	o.Run("head", "-c", "10000", "/dev/zero")
+	e := o.Transcript()[0]
+	if len(e.Stdout) != maxTranscriptOutput+len("...(truncated)") {
+		t.Fatalf("expected stdout to be truncated, but got %d bytes",
+			len(e.Stdout))
+	}
+}
+
+func TestFakeExecutor(t *testing.T) {
+	fake := &FakeExecutor{}
+	fake.Expect("git", "rev-parse", "HEAD").InDir("/repo").Returns("abc\n")
+	commit := fake.Expect("git", "commit", "-F", "-")
+	fake.Expect("echo", "hi").Returns("hi\n")
+	fake.Expect("tr", "a-z", "A-Z").Returns("HI\n")
+	fake.Expect("git", "push").Fails(1, "rejected")
+
+	o := StartOp().Executor(fake)
+	o.Dir("/repo")
+	o.CollectStdOut()
+	o.Run("git", "rev-parse", "HEAD")
+	if o.Output() != "abc\n" {
+		t.Fatalf("expected canned output \"abc\\n\", but got %q", o.Output())
+	}
+	o.InputFrom(strings.NewReader("message"))
+	o.Run("git", "commit", "-F", "-")
+	if commit.Stdin != "message" {
+		t.Fatalf("expected fake command to read \"message\", but got %q",
+			commit.Stdin)
+	}
+	o.InputFrom(nil)
+	o.Pipe([]string{"echo", "hi"}, []string{"tr", "a-z", "A-Z"})
+	if o.Output() != "HI\n" {
+		t.Fatalf("expected pipeline output \"HI\\n\", but got %q", o.Output())
+	}
+	o.Run("git", "push")
+	if string(o.LastErrorMsg()) != "rejected" {
+		t.Fatalf("expected canned stderr \"rejected\", but got %q",
+			o.LastErrorMsg())
+	}
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(o.LastError(), &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1, but got %v", o.LastError())
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeExecutorMismatch(t *testing.T) {
+	fake := &FakeExecutor{}
+	fake.Expect("git", "fetch")
+	fake.Expect("git", "rebase", "master")
+	o := StartOp().Executor(fake)
+	if err := o.Run("git", "pull"); err == nil {
+		t.Fatal("expected unexpected command to fail, but it succeeded")
+	}
+	err := fake.Verify()
+	if err == nil || !strings.Contains(err.Error(), "but got: git pull") ||
+		!strings.Contains(err.Error(), "not run: git rebase master") {
+		t.Fatalf("expected Verify() to report both mismatches, but got: %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	lockErr := "fatal: Unable to create '/r/.git/index.lock': File exists.\n"
+	fake := &FakeExecutor{}
+	first := fake.Expect("git", "commit", "-F", "-").Fails(128, lockErr)
+	fake.Expect("git", "commit", "-F", "-").Fails(128, lockErr)
+	last := fake.Expect("git", "commit", "-F", "-")
+
+	o := StartOp().Executor(fake).Retry(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		Retryable:   []*regexp.Regexp{regexp.MustCompile(`index\.lock`)},
+	})
+	o.RecordTranscript()
+	o.InputFrom(strings.NewReader("message"))
+	if err := o.Run("git", "commit", "-F", "-"); err != nil {
+		t.Fatal(err)
+	}
+	if first.Stdin != "message" || last.Stdin != "message" {
+		t.Fatalf("expected every attempt to read \"message\", but got %q and %q",
+			first.Stdin, last.Stdin)
+	}
+	if entries := o.Transcript(); len(entries) != 3 || entries[2].Attempt != 3 {
+		t.Fatalf("expected a transcript entry for each attempt, but got %+v",
+			entries)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 2,
+		Retryable:   []*regexp.Regexp{regexp.MustCompile(`Connection reset`)},
+	}
+	fake := &FakeExecutor{}
+	fake.Expect("git", "fetch").Fails(128, "fatal: Connection reset by peer\n")
+	fake.Expect("git", "fetch").Fails(128, "fatal: Connection reset by peer\n")
+	fake.Expect("git", "push").Fails(1, "rejected\n")
+
+	o := StartOp().Executor(fake)
+	o.RunWithRetry(policy, "git", "fetch")
+	err := o.DetailedError()
+	if err == nil || !strings.Contains(err.Error(), "after 2 attempts") ||
+		!strings.Contains(err.Error(), "attempt 1: exit status 128: fatal: "+
+			"Connection reset by peer") {
+		t.Fatalf("expected error to describe both attempts, but got: %v", err)
+	}
+
+	// Failures that don't match the policy aren't retried
+	o = StartOp().Executor(fake).Retry(policy)
+	if err := o.Run("git", "push"); err == nil {
+		t.Fatal("expected 'git push' to fail, but it succeeded")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second,
+		4 * time.Second, 5 * time.Second} {
+		if got := p.backoff(attempt + 1); got != want {
+			t.Errorf("backoff(%d): expected %v, but got %v", attempt+1, want, got)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	g := NewGroup(context.Background(), 2)
+	g.Run("a", "echo", "a")
+	g.Run("b", "sh", "-c", "echo b-failed >&2; exit 1")
+	g.Run("c", "echo", "c")
+	g.Run("d", "/does/not/exist")
+	err := g.Wait()
+
+	var groupErr *GroupError
+	if !errors.As(err, &groupErr) || len(groupErr.Failed) != 2 ||
+		groupErr.Total != 4 {
+		t.Fatalf("expected 2 of 4 commands to fail, but got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "[b]") ||
+		!strings.Contains(err.Error(), "b-failed") ||
+		!strings.Contains(err.Error(), "[d]") {
+		t.Fatalf("expected error to describe both failures, but got: %v", err)
+	}
+	results := g.Results()
+	if results[0].Output != "a\n" || results[2].Output != "c\n" {
+		t.Fatalf("expected outputs of successful commands, but got %+v", results)
+	}
+}
+
+func TestGroupParallelism(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	g := NewGroup(context.Background(), 3)
+	for i := 0; i < 10; i++ {
+		g.Go(fmt.Sprint(i), func(o *Op) error {
+			mu.Lock()
+			if running++; running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning != 3 {
+		t.Fatalf("expected at most 3 tasks to run at once, but got %d",
+			maxRunning)
+	}
+}
+
+func TestGroupCancelOnFailure(t *testing.T) {
+	start := time.Now()
+	g := NewGroup(context.Background(), 2).CancelOnFailure()
+	g.Run("slow", "sleep", "10")
+	g.Run("fails", "false")
+	g.Run("never-started", "sleep", "10")
+	err := g.Wait()
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("expected remaining commands to be killed, but Wait() took %v",
+			time.Since(start))
+	}
+	var groupErr *GroupError
+	if !errors.As(err, &groupErr) || len(groupErr.Failed) != 1 ||
+		groupErr.Canceled != 2 {
+		t.Fatalf("expected 1 failure and 2 cancellations, but got: %v", err)
+	}
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("expected errors.Is(err, ErrCanceled) to hold for %v", err)
+	}
+}
+
+func TestGroupCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := NewGroup(ctx, 1)
+	g.Go("canceled", func(o *Op) error {
+		cancel()
+		return o.Run("sleep", "10")
+	})
+	g.Run("never-started", "sleep", "10")
+	err := g.Wait()
+
+	var groupErr *GroupError
+	if !errors.As(err, &groupErr) || len(groupErr.Failed) != 0 ||
+		groupErr.Canceled != 2 {
+		t.Fatalf("expected 2 cancellations, but got: %v", err)
+	}
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("expected errors.Is(err, ErrCanceled) to hold for %v", err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	fake := &FakeExecutor{}
+	fake.Expect("mkdir", "/c")
+	fake.Expect("cp", "-r", "/t", "/c")
+	fake.Expect("init").InDir("/c").Fails(2, "init failed")
+	fake.Expect("rm", "-rf", "/c").InDir("/")
+	fake.Expect("rm", "/lock").Fails(1, "no such file")
+	fake.Expect("rmdir", "/c")
+
+	o := StartOp().Executor(fake)
+	o.Finally("rmdir", "/c")
+	o.Run("mkdir", "/c")
+	o.Finally("rm", "/lock")
+	o.Dir("/")
+	o.Rollback("rm", "-rf", "/c")
+	o.Run("cp", "-r", "/t", "/c")
+	o.Dir("/c")
+	o.Run("init")
+	o.Rollback("never", "registered") // 'init' already failed
+
+	err := o.Cleanup()
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Fatalf("expected Cleanup() to report failed 'rm', but got: %v", err)
+	}
+	if !strings.Contains(o.DetailedError().Error(), "init failed") {
+		t.Fatalf("expected DetailedError() to describe 'init' after Cleanup(), "+
+			"but got: %v", o.DetailedError())
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupOnSuccess(t *testing.T) {
+	fake := &FakeExecutor{}
+	fake.Expect("step")
+	fake.Expect("finally")
+
+	o := StartOp().Executor(fake)
+	o.Finally("finally")
+	o.Rollback("rollback") // not run, because nothing fails
+	o.Run("step")
+	if err := o.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanupAfterCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	// Even if the Op's context is canceled, its deferred steps run
+	ctx, cancel := context.WithCancel(context.Background())
+	o := StartOpWithContext(ctx)
+	o.Rollback("touch", marker)
+	cancel()
+	o.Run("sleep", "10")
+	if err := o.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("expected rollback step to create %s, but: %v", marker, err)
+	}
+	if !errors.Is(o.LastError(), ErrCanceled) {
+		t.Fatalf("expected Op to have been canceled, but got %v", o.LastError())
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	// First run: 'build' fails after two steps have finished
+	fake := &FakeExecutor{}
+	fake.Expect("fetch")
+	fake.Expect("rev-parse").Returns("abc\n")
+	fake.Expect("build", "abc").Fails(1, "build failed")
+	o := StartOp().Executor(fake).Journal(journal, nil)
+	o.Run("fetch")
+	o.CollectStdOut()
+	o.StepID("rev").Run("rev-parse")
+	o.Run("build", strings.TrimSpace(o.Output()))
+	if o.LastError() == nil {
+		t.Fatal("expected 'build' to fail, but it succeeded")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second run: only 'build' runs, and 'rev-parse''s output is restored
+	var log bytes.Buffer
+	fake = &FakeExecutor{}
+	fake.Expect("build", "abc")
+	o = StartOp().Executor(fake).Journal(journal, &log)
+	o.Run("fetch")
+	o.CollectStdOut()
+	o.StepID("rev").Run("rev-parse")
+	o.Run("build", strings.TrimSpace(o.Output()))
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(log.String(), "skipping step") != 2 {
+		t.Fatalf("expected two steps to be skipped, but got:\n%s", log.String())
+	}
+	if err := o.DiscardJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be deleted, but got %v", err)
+	}
+}
+
+func TestJournalMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	fake := &FakeExecutor{}
+	fake.Expect("a")
+	fake.Expect("b")
+	fake.Expect("c").Fails(1, "")
+	o := StartOp().Executor(fake).Journal(journal, nil)
+	o.Run("a")
+	o.Run("b")
+	o.Run("c")
+
+	// 'b' changed, so it and everything after it run again
+	var log bytes.Buffer
+	fake = &FakeExecutor{}
+	fake.Expect("b", "--new-flag")
+	fake.Expect("c")
+	o = StartOp().Executor(fake).Journal(journal, &log)
+	o.Run("a")
+	o.Run("b", "--new-flag")
+	o.Run("c")
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "warning: step 2 is now \"b --new-flag\"") {
+		t.Fatalf("expected a warning about step 2, but got:\n%s", log.String())
+	}
+}
+
+func TestJournalDo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	// run runs an Op with two Do() steps around a command, and returns which
+	// Do() steps ran
+	run := func(fake *FakeExecutor, branch string,
+		checkErr error) (*Op, []string) {
+		var ran []string
+		o := StartOp().Executor(fake).Journal(journal, nil).ExpandVars()
+		o.StepID("branch").Do(func() error {
+			ran = append(ran, "branch")
+			o.SetVar("branch", branch)
+			return nil
+		})
+		o.Run("push", "{{branch}}")
+		o.StepID("check").Do(func() error {
+			ran = append(ran, "check")
+			return checkErr
+		})
+		return o, ran
+	}
+
+	// First run: 'check' fails after the other steps have finished
+	fake := &FakeExecutor{}
+	fake.Expect("push", "feature")
+	checkErr := errors.New("not merged yet")
+	o, _ := run(fake, "feature", checkErr)
+	if !errors.Is(o.LastError(), checkErr) {
+		t.Fatalf("expected 'check' to fail, but got %v", o.LastError())
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second run: only 'check' runs, and the variable set by 'branch' is
+	// restored (even though the branch would now be different)
+	fake = &FakeExecutor{}
+	o, ran := run(fake, "HEAD", nil)
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []string{"check"}) {
+		t.Fatalf("expected only 'check' to run, but got %v", ran)
+	}
+	if branch, _ := o.Var("branch"); branch != "feature" {
+		t.Fatalf("expected variable 'branch' to be restored as \"feature\", "+
+			"but got %q", branch)
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	// pgid returns the process group of a command run by 'o'
+	pgid := func(o *Op) string {
+		o.CollectStdOut()
+		if err := o.Run("sh", "-c", "ps -o pgid= -p $$"); err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(o.Output())
+	}
+
+	// Commands run in the caller's process group (so that, like commands run
+	// by a shell, they can read from the terminal), unless they have a timeout
+	if got, want := pgid(StartOp()), fmt.Sprint(syscall.Getpgrp()); got != want {
+		t.Errorf("expected command to run in process group %s, but got %s", want,
+			got)
+	}
+	if got := pgid(StartOp().Timeout(time.Minute)); got ==
+		fmt.Sprint(syscall.Getpgrp()) {
+		t.Errorf("expected command with a timeout to run in its own process " +
+			"group, but it ran in the caller's")
+	}
+}
+
+func TestError(t *testing.T) {
+	o := StartOp()
+	o.Chdir("/")
+	o.Run("true")
+	o.Run("sh", "-c", "echo oops >&2; exit 3")
+	var opErr *Error
+	if err := o.DetailedError(); !errors.As(err, &opErr) {
+		t.Fatalf("expected DetailedError() to be an *Error, but got %T", err)
+	}
+	if opErr.Step != 2 || opErr.ExitCode != 3 || opErr.Signal != 0 ||
+		opErr.Dir != "/" || string(opErr.Stderr) != "oops\n" ||
+		opErr.Args[0] != "sh" {
+		t.Fatalf("unexpected error fields: %+v", opErr)
+	}
+
+	o = StartOp()
+	o.Pipe([]string{"echo", "hi"}, []string{"sh", "-c", "kill -9 $$"})
+	if !errors.As(o.DetailedError(), &opErr) {
+		t.Fatalf("expected an *Error, but got %v", o.DetailedError())
+	}
+	if opErr.Step != 0 || opErr.Stage != 2 || opErr.Signal != syscall.SIGKILL ||
+		opErr.ExitCode != -1 {
+		t.Fatalf("expected stage 2 to be killed by SIGKILL, but got %+v", opErr)
+	}
+	// Args is the failed stage (with its words intact), and Pipeline is the
+	// whole pipeline
+	if want := []string{"sh", "-c", "kill -9 $$"}; !reflect.DeepEqual(
+		opErr.Args, want) || len(opErr.Pipeline) != 2 ||
+		!reflect.DeepEqual(opErr.Pipeline[1], want) {
+		t.Fatalf("expected Args %q in a 2-stage Pipeline, but got %q in %q", want,
+			opErr.Args, opErr.Pipeline)
+	}
+
+	// A command that fails after a pipeline has no Pipeline
+	o = StartOp()
+	o.Pipe([]string{"echo", "hi"}, []string{"cat"})
+	o.Run("false")
+	if !errors.As(o.DetailedError(), &opErr) || opErr.Args[0] != "false" ||
+		opErr.Pipeline != nil {
+		t.Fatalf("expected 'false' to fail outside a pipeline, but got %+v",
+			opErr)
+	}
+
+	o = StartOp().Timeout(10 * time.Millisecond)
+	o.Run("sleep", "10")
+	if !errors.As(o.DetailedError(), &opErr) ||
+		!errors.Is(o.DetailedError(), ErrTimeout) {
+		t.Fatalf("expected a timeout *Error, but got %v", o.DetailedError())
+	}
+}
+
+func TestTee(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	o := StartOp()
+	o.CollectStdOut()
+	o.TeeStdOut(&stdout)
+	o.TeeStdErr(&stderr)
+	o.Run("sh", "-c", "echo out; echo err >&2; exit 1")
+	if o.Output() != "out\n" || stdout.String() != "out\n" {
+		t.Fatalf("expected stdout to be collected and teed, but got %q and %q",
+			o.Output(), stdout.String())
+	}
+	if string(o.LastErrorMsg()) != "err" || stderr.String() != "err\n" {
+		t.Fatalf("expected stderr to be captured and teed, but got %q and %q",
+			o.LastErrorMsg(), stderr.String())
+	}
+
+	// Pipelines tee the last stage's stdout and every stage's stderr
+	stdout.Reset()
+	stderr.Reset()
+	o = StartOp().TeeStdOut(&stdout).TeeStdErr(&stderr)
+	o.Pipe([]string{"sh", "-c", "echo a; echo b >&2"}, []string{"tr", "a", "c"})
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "c\n" || stderr.String() != "b\n" {
+		t.Fatalf("unexpected tee output %q and %q", stdout.String(),
+			stderr.String())
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that's safe for concurrent writes, like a
+// terminal
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestTeePrefixLines(t *testing.T) {
+	var term lockedBuffer
+	var wg sync.WaitGroup
+	for _, label := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			o := StartOp().TeeStdOut(&term).TeeStdErr(&term).PrefixLines(label)
+			// Write lines a byte at a time, so that unprefixed output would mix
+			o.Run("sh", "-c", "for i in 1 2 3; do printf l; printf i; printf \"$i\\n\";"+
+				" done; printf partial >&2")
+			if err := o.DetailedError(); err != nil {
+				t.Error(err)
+			}
+		}(label)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(term.buf.String()), "\n")
+	counts := make(map[string]int)
+	for _, l := range lines {
+		counts[l]++
+	}
+	for _, label := range []string{"a", "b"} {
+		for _, l := range []string{"li1", "li2", "li3", "partial"} {
+			if line := "[" + label + " sh -c] " + l; counts[line] != 1 {
+				t.Fatalf("expected output to contain %q once, but got:\n%s", line,
+					term.buf.String())
+			}
+		}
+	}
+	if len(lines) != 8 {
+		t.Fatalf("expected 8 lines of output, but got:\n%s", term.buf.String())
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var observed []Usage
+	o := StartOp().OnUsage(func(u Usage) { observed = append(observed, u) })
+	o.Run("sh", "-c", "i=0; while [ $i -lt 50000 ]; do i=$((i+1)); done")
+	o.Pipe([]string{"echo", "hi"}, []string{"cat"})
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	usage := o.Usage()
+	if len(usage) != 2 || len(observed) != 2 {
+		t.Fatalf("expected usage of 2 steps, but got %v (observed %v)", usage,
+			observed)
+	}
+	if u := usage[0]; u.Args[0] != "sh" || u.User+u.System <= 0 ||
+		u.Wall <= 0 || u.MaxRSS < 1<<10 {
+		t.Fatalf("unexpected usage of the first command: %v", u)
+	}
+	if u := usage[1]; u.Args[0] != "echo" || u.MaxRSS <= 0 {
+		t.Fatalf("unexpected usage of the pipeline: %v", u)
+	}
+
+	// Commands run by a FakeExecutor have no CPU usage, but are still timed
+	fake := &FakeExecutor{}
+	fake.Expect("git", "fetch")
+	o = StartOp().Executor(fake)
+	o.Run("git", "fetch")
+	if u := o.Usage(); len(u) != 1 || u[0].User != 0 || u[0].MaxRSS != 0 {
+		t.Fatalf("expected zero usage from a fake command, but got %v", u)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	o := StartOp().ExpandVars()
+	o.Capture("greeting").Run("echo", "  hello  ")
+	o.CaptureMatch("n", regexp.MustCompile(`count: (\d+)`)).
+		Run("echo", "total count: 42 files")
+	o.Capture("upper").Pipe([]string{"echo", "{{greeting}}"},
+		[]string{"tr", "a-z", "A-Z"})
+	o.CollectStdOut()
+	o.Run("echo", "{{upper}}-{{n}}", "{{greeting}}")
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if got := o.Output(); got != "HELLO-42 hello\n" {
+		t.Fatalf("expected \"HELLO-42 hello\\n\", but got %q", got)
+	}
+	if v, ok := o.Var("n"); !ok || v != "42" {
+		t.Fatalf("expected n to be \"42\", but got %q (set: %t)", v, ok)
+	}
+
+	// Referring to an undefined variable is an error
+	o = StartOp().ExpandVars()
+	o.Run("echo", "{{nope}}")
+	if err := o.DetailedError(); !errors.Is(err, ErrUndefinedVariable) ||
+		!strings.Contains(err.Error(), `"nope"`) {
+		t.Fatalf("expected undefined variable error, but got %v", err)
+	}
+
+	// So is output that doesn't match
+	o = StartOp()
+	o.CaptureMatch("n", regexp.MustCompile(`count: (\d+)`)).Run("echo", "none")
+	if err := o.DetailedError(); err == nil ||
+		!strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected capture to fail, but got %v", err)
+	}
+	if _, ok := o.Var("n"); ok {
+		t.Fatal("expected n to be unset after a failed capture")
+	}
+}
+
+func TestLiteralTemplates(t *testing.T) {
+	// Without ExpandVars(), "{{...}}" in arguments (e.g. Go templates) is
+	// passed to commands unchanged
+	tmpl := "{{range .Imports}}{{.}} {{end}}"
+	fake := &FakeExecutor{}
+	fake.Expect("go", "list", "-f", tmpl, "fmt")
+	fake.Expect("git", "log", "--format={{end}}")
+	o := StartOp().Executor(fake)
+	o.Run("go", "list", "-f", tmpl, "fmt")
+	o.Run("git", "log", "--format={{end}}")
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// With ExpandVars(), escaped references are passed through as-is
+	fake = &FakeExecutor{}
+	fake.Expect("echo", "main {{branch}}", tmpl)
+	o = StartOp().Executor(fake).ExpandVars().SetVar("branch", "main")
+	o.Run("echo", `{{branch}} \{{branch}}`, `{{range .Imports}}{{.}} \{{end}}`)
+	if err := o.DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureDryRun(t *testing.T) {
+	o := StartOp().DryRun(nil).ExpandVars()
+	o.SetVar("branch", "my branch")
+	o.Capture("base").Run("git", "merge-base", "HEAD", "{{branch}}")
+	o.Run("git", "diff", "{{base}}..{{branch}}", "{{base}}")
+	expected := "base=$(git merge-base HEAD 'my branch')\n" +
+		`git diff "${base}"'..my branch' "${base}"` + "\n"
+	if got := o.Script(); !strings.HasSuffix(got, "\n\n"+expected) {
+		t.Fatalf("expected script to end with:\n%s\nbut got:\n%s", expected,
+			got)
+	}
+	if _, ok := o.Var("base"); ok {
+		t.Fatal("expected variable captured in dry-run mode to be unset")
+	}
+}
+
+func TestCaptureJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "op-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	run := func(fake *FakeExecutor) *Op {
+		o := StartOp().Executor(fake).Journal(journal, nil).ExpandVars()
+		o.Capture("base").Run("git", "merge-base", "HEAD", "master")
+		o.Run("git", "rebase", "--onto", "{{base}}", "master")
+		return o
+	}
+	fake := &FakeExecutor{}
+	fake.Expect("git", "merge-base", "HEAD", "master").Returns("abc123\n")
+	fake.Expect("git", "rebase", "--onto", "abc123", "master").Fails(1, "oops")
+	if run(fake).LastError() == nil {
+		t.Fatal("expected first run to fail")
+	}
+
+	// The second run skips 'git merge-base', but still knows its result
+	fake = &FakeExecutor{}
+	fake.Expect("git", "rebase", "--onto", "abc123", "master")
+	if err := run(fake).DetailedError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package op
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// pipelineString returns 'cmds' formatted as a bash pipeline
+func pipelineString(cmds [][]string) string {
+	stages := make([]string, len(cmds))
+	for i, args := range cmds {
+		stages[i] = shellCommand(args)
+	}
+	return strings.Join(stages, " | ")
+}
+
+// pipelineArgs returns the words of every command in 'cmds', with "|"
+// between the stages. It describes a whole pipeline in places that expect a
+// single command's arguments (e.g. Usage and TranscriptEntry).
+func pipelineArgs(cmds [][]string) []string {
+	var args []string
+	for i, stage := range cmds {
+		if i > 0 {
+			args = append(args, "|")
+		}
+		args = append(args, stage...)
+	}
+	return args
+}
+
+// Pipe runs 'cmds' concurrently as a pipeline, with each command's stdout
+// connected to the next command's stdin (assuming no previous commands have
+// failed). The first command reads from the Op's input (see InputFrom()) and
+// the last command writes to the Op's output (see OutputTo()).
+//
+// Like a bash pipeline with 'set -o pipefail', the pipeline fails if any
+// command in it fails, and the error is that of the last command to fail.
+// DetailedError() reports which stage that was, along with its stderr (each
+// stage's stderr is captured separately).
+func (o *Op) Pipe(cmds ...[]string) error {
+	// Only run while the whole Op is still successful
+	if o.err != nil {
+		return o.err
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	o.resetBuffers()
+	o.beginStepStatus() // pipelines aren't retried
+	o.args, o.pipeline = pipelineArgs(cmds), cmds
+	c := o.takeCapture()
+	expanded := make([][]string, len(cmds))
+	lines := make([]string, len(cmds))
+	for i, args := range cmds {
+		var err error
+		if expanded[i], lines[i], err = o.expand(args); err != nil {
+			o.action, o.err = "could not expand arguments", err
+			return o.err
+		}
+	}
+	cmds = expanded
+	o.args, o.pipeline = pipelineArgs(cmds), cmds
+	step, skip := o.beginJournalStep()
+	if skip {
+		return nil
+	}
+	o.record(c.scriptLine(strings.Join(lines, " | ")))
+	if o.dryRun {
+		o.dryRunCapture(c)
+		return o.endJournalStep(step)
+	}
+	ctx, cancel := o.cmdContext()
+	defer cancel()
+
+	// Create one Cmd per stage, connected by OS pipes
+	var (
+		stages  = make([]*Cmd, len(cmds))
+		procs   = make([]Process, len(cmds))
+		stderrs = make([]bytes.Buffer, len(cmds))
+		flushes []func()   // flush each stage's tees (see tee())
+		pipes   []*os.File // parent's copies of pipe fds; closed after Start()
+	)
+	defer func() {
+		for _, flush := range flushes {
+			flush()
+		}
+	}()
+	closePipes := func() {
+		for _, p := range pipes {
+			p.Close()
+		}
+		pipes = nil
+	}
+	defer closePipes()
+	for i, args := range cmds {
+		stages[i] = o.command(args)
+		var flush func()
+		stages[i].Stderr, flush = o.tee(args, &stderrs[i], o.stderrTees)
+		flushes = append(flushes, flush)
+		if i > 0 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				o.err, o.action = err, "could not create pipe"
+				return o.err
+			}
+			pipes = append(pipes, r, w)
+			stages[i-1].Stdout = w
+			stages[i].Stdin = r
+		}
+	}
+	stages[0].Stdin = o.input
+	trace := o.beginStep(o.args)
+	stdout, flush := o.tee(cmds[len(cmds)-1],
+		c.stdoutFor(trace.stdoutFor(o.output)), o.stdoutTees)
+	stages[len(stages)-1].Stdout = stdout
+	flushes = append(flushes, flush)
+
+	// Start all stages, then close the parent's copies of the pipes, so that
+	// each stage sees EOF (or SIGPIPE) when its neighbor exits
+	started := 0
+	start := time.Now()
+	var startErr error
+	for ; started < len(stages); started++ {
+		procs[started], startErr = o.executor.Start(ctx, stages[started])
+		if startErr != nil {
+			cancel() // kill the stages that did start
+			break
+		}
+	}
+	closePipes()
+
+	// Wait for all stages, and keep the error of the last one to fail
+	failed := -1
+	var err error
+	for i := 0; i < started; i++ {
+		if waitErr := procs[i].Wait(); waitErr != nil {
+			failed, err = i, waitErr
+		}
+	}
+	if startErr != nil {
+		failed, err = started, startErr
+	}
+	o.recordUsage(trace, o.args, start, procs...)
+	if failed < 0 {
+		o.endStep(trace, nil, nil)
+		if o.endCapture(c, &step) != nil {
+			return o.err
+		}
+		return o.endJournalStep(step)
+	}
+	o.errMsg.Write(stderrs[failed].Bytes())
+	o.endStep(trace, o.errMsg.Bytes(), err)
+	o.exitCode, o.signal = exitStatus(err)
+	o.stage = failed + 1
+	o.action, o.err = o.cmdError(ctx, err)
+	o.action = fmt.Sprintf("%s: stage %d of %d of pipeline \"%s\"", o.action,
+		failed+1, len(cmds), pipelineString(cmds))
+	o.args = cmds[failed] // DetailedError() reports the failed stage
+	return o.err
+}
@@ -0,0 +1,83 @@
+package op
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// RetryPolicy describes which failed commands an Op retries, and how
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a command is run (including
+	// the first). If it's 0 or 1, commands aren't retried.
+	MaxAttempts int
+
+	// Backoff is how long the Op waits before the first retry. The wait doubles
+	// before each subsequent retry, up to MaxBackoff (if set).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable matches the stderr of failures that are worth retrying (e.g.
+	// network errors). Commands whose stderr doesn't match any of these, and
+	// commands that timed out or were canceled, aren't retried.
+	Retryable []*regexp.Regexp
+}
+
+// Retry directs 'o' to retry subsequent commands (run with Run()) according
+// to 'p'. Passing the zero RetryPolicy turns retries off.
+func (o *Op) Retry(p RetryPolicy) *Op {
+	o.retry = p
+	return o
+}
+
+// RunWithRetry is like Run(), but it retries the command according to 'p'
+// instead of the Op's retry policy
+func (o *Op) RunWithRetry(p RetryPolicy, args ...string) error {
+	prev := o.retry
+	o.retry = p
+	defer func() { o.retry = prev }()
+	return o.Run(args...)
+}
+
+// shouldRetry returns true if a command that just failed on its 'attempt'th
+// try (with the error 'err' and stderr 'stderr') should be run again
+func (p *RetryPolicy) shouldRetry(attempt int, err error, stderr []byte) bool {
+	if attempt >= p.MaxAttempts ||
+		errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) {
+		return false
+	}
+	for _, r := range p.Retryable {
+		if r.Match(stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait after the 'attempt'th try of a command
+// before trying again
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return d
+}
+
+// describeAttempt summarizes a failed attempt to run a command, for the
+// Op's error context
+func describeAttempt(attempt int, err error, stderr []byte) string {
+	stderr = bytes.TrimSpace(stderr)
+	if i := bytes.IndexByte(stderr, '\n'); i >= 0 {
+		stderr = stderr[:i]
+	}
+	if len(stderr) == 0 {
+		return fmt.Sprintf("attempt %d: %v", attempt, err)
+	}
+	return fmt.Sprintf("attempt %d: %v: %s", attempt, err, stderr)
+}
@@ -0,0 +1,60 @@
+package op
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// safeShellWord matches strings that don't need to be quoted in bash
+var /* const */ safeShellWord = regexp.MustCompile(`^[[:alnum:]_@%+=:,./-]+$`)
+
+// shellQuote quotes 's' (if necessary) so that bash interprets it as a single
+// word with no expansions
+func shellQuote(s string) string {
+	if safeShellWord.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellCommand formats 'args' as a line of bash
+func shellCommand(args []string) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = shellQuote(arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// DryRun switches 'o' into dry-run mode: subsequent calls to Run(), Pipe()
+// and Chdir() record their commands (see Script()) instead of running them,
+// and always succeed. If 'w' is non-nil, each command is also written to 'w'
+// (as a line of bash) as it's recorded.
+func (o *Op) DryRun(w io.Writer) *Op {
+	o.dryRun = true
+	o.dryRunOut = w
+	return o
+}
+
+// record appends 'line' to the Op's script, and prints it if 'o' is in
+// dry-run mode
+func (o *Op) record(line string) {
+	o.script = append(o.script, line)
+	if o.dryRun && o.dryRunOut != nil {
+		fmt.Fprintln(o.dryRunOut, line)
+	}
+}
+
+// Script returns the commands that 'o' has run (or, in dry-run mode, would
+// have run) as an equivalent bash script
+func (o *Op) Script() string {
+	var buf bytes.Buffer // bytes.Buffer.Write() does not return errors
+	buf.WriteString("#!/bin/bash\nset -euo pipefail\n\n")
+	for _, line := range o.script {
+		buf.WriteString(line + "\n")
+	}
+	return buf.String()
+}
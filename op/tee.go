@@ -0,0 +1,109 @@
+package op
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// TeeStdOut directs 'o' to copy the stdout of subsequent commands to each of
+// 'w', in addition to collecting it (see CollectStdOut()) or writing it to
+// the Op's output (see OutputTo())
+func (o *Op) TeeStdOut(w ...io.Writer) *Op {
+	o.stdoutTees = append(o.stdoutTees, w...)
+	return o
+}
+
+// TeeStdErr directs 'o' to copy the stderr of subsequent commands to each of
+// 'w' as the commands run (it's still captured for LastErrorMsg() and
+// DetailedError() as well)
+func (o *Op) TeeStdErr(w ...io.Writer) *Op {
+	o.stderrTees = append(o.stderrTees, w...)
+	return o
+}
+
+// PrefixLines directs 'o' to prefix each line that it copies to a tee (see
+// TeeStdOut() and TeeStdErr()) with 'label' and the command that wrote it,
+// e.g. "[client-a git fetch] ". Lines are written to each tee whole, so that
+// the output of several Ops writing to one terminal isn't interleaved
+// mid-line (a tee shared by several Ops must be safe for concurrent writes,
+// as os.Stdout and os.Stderr are).
+func (o *Op) PrefixLines(label string) *Op {
+	o.prefixLines, o.prefixLabel = true, label
+	return o
+}
+
+// linePrefix returns the prefix of lines written by 'args' (see
+// PrefixLines())
+func (o *Op) linePrefix(args []string) string {
+	words := []string{}
+	if o.prefixLabel != "" {
+		words = append(words, o.prefixLabel)
+	}
+	if len(args) > 0 {
+		words = append(words, filepath.Base(args[0]))
+	}
+	if len(args) > 1 {
+		words = append(words, args[1])
+	}
+	return "[" + strings.Join(words, " ") + "] "
+}
+
+// tee returns a writer that writes to 'w' (if non-nil) and to each of 'tees',
+// for the command 'args'. The returned function must be called once the
+// command exits, to write any partial last line to the tees.
+func (o *Op) tee(args []string, w io.Writer, tees []io.Writer) (io.Writer,
+	func()) {
+	if len(tees) == 0 {
+		return w, func() {}
+	}
+	var ws []io.Writer
+	if w != nil {
+		ws = append(ws, w)
+	}
+	var lws []*lineWriter
+	for _, t := range tees {
+		if o.prefixLines {
+			lw := &lineWriter{w: t, prefix: o.linePrefix(args)}
+			lws = append(lws, lw)
+			t = lw
+		}
+		ws = append(ws, t)
+	}
+	return io.MultiWriter(ws...), func() {
+		for _, lw := range lws {
+			lw.flush()
+		}
+	}
+}
+
+// lineWriter prefixes each line written to it with 'prefix', and writes
+// each line to 'w' with a single call to Write(). Errors from 'w' are ignored,
+// so that a broken tee doesn't cause the command writing to it to fail.
+type lineWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte // an incomplete line
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.w.Write(append([]byte(l.prefix), l.buf[:i+1]...))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes any incomplete line in 'l' (with a newline added)
+func (l *lineWriter) flush() {
+	if len(l.buf) > 0 {
+		l.w.Write(append(append([]byte(l.prefix), l.buf...), '\n'))
+		l.buf = nil
+	}
+}
@@ -0,0 +1,15 @@
+package op
+
+// Interactive directs 'o' to run subsequent commands (see Run()) in a
+// pseudo-terminal connected to the user's terminal, so that interactive
+// programs like vim, 'git rebase -i' and 'git add -p' work. While such a
+// command runs, the user's terminal is put in raw mode (so that keystrokes,
+// including Ctrl-C, go to the command), and changes to its size are forwarded
+// to the command. The terminal is restored when the command exits.
+//
+// Interactive commands' output goes to the terminal, so it isn't collected
+// or written to the Op's output, and LastErrorMsg() is empty if they fail.
+func (o *Op) Interactive() *Op {
+	o.interactive = true
+	return o
+}
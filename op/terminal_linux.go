@@ -0,0 +1,212 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// control calls 'f' with the file descriptor of 'file'. Unlike file.Fd(), it
+// doesn't put 'file' in blocking mode, so that reads from it can still be
+// interrupted by closing it.
+func control(file *os.File, f func(fd int) error) error {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// openPTY opens a new pseudo-terminal, and returns its controlling (ptm) and
+// terminal (pts) ends
+func openPTY() (ptm, pts *os.File, err error) {
+	ptm, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n int
+	if err := control(ptm, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return err // could not unlock pts
+		}
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	}); err != nil {
+		ptm.Close()
+		return nil, nil, fmt.Errorf("could not set up pseudo-terminal: %w", err)
+	}
+	pts, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n),
+		os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, pts, nil
+}
+
+// copySize sets the window size of the terminal 'to' to that of 'from'
+func copySize(from, to *os.File) error {
+	var ws *unix.Winsize
+	if err := control(from, func(fd int) (err error) {
+		ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+		return err
+	}); err != nil {
+		return err
+	}
+	return control(to, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws)
+	})
+}
+
+// makeRaw puts the terminal 'tty' in raw mode (like cfmakeraw(3)), and
+// returns its previous state
+func makeRaw(tty *os.File) (*unix.Termios, error) {
+	var saved *unix.Termios
+	err := control(tty, func(fd int) (err error) {
+		saved, err = unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		raw := *saved
+		raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+			unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		raw.Oflag &^= unix.OPOST
+		raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG |
+			unix.IEXTEN
+		raw.Cflag &^= unix.CSIZE | unix.PARENB
+		raw.Cflag |= unix.CS8
+		raw.Cc[unix.VMIN], raw.Cc[unix.VTIME] = 1, 0
+		return unix.IoctlSetTermios(fd, unix.TCSETS, &raw)
+	})
+	return saved, err
+}
+
+// restore returns the terminal 'tty' to the state 'saved'
+func restore(tty *os.File, saved *unix.Termios) error {
+	return control(tty, func(fd int) error {
+		return unix.IoctlSetTermios(fd, unix.TCSETS, saved)
+	})
+}
+
+// terminalProcess is a command running in a pseudo-terminal (see
+// startTerminal())
+type terminalProcess struct {
+	cmd      *exec.Cmd
+	tty, ptm *os.File
+	saved    *unix.Termios
+	winch    chan os.Signal
+	done     chan struct{} // closed by Wait(), to stop forwarding resizes
+	output   chan struct{} // closed once the command's output is copied
+}
+
+// startTerminal starts 'c' in a new pseudo-terminal, and connects the
+// pseudo-terminal to the user's terminal at the path 'tty' (see
+// OSExecutor.TTY)
+func startTerminal(ctx context.Context, tty string, c *Cmd) (Process, error) {
+	p := &terminalProcess{
+		winch:  make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+		output: make(chan struct{}),
+	}
+	var err error
+	if p.tty, err = os.OpenFile(tty, os.O_RDWR, 0); err != nil {
+		return nil, fmt.Errorf("could not open terminal: %w", err)
+	}
+	ptm, pts, err := openPTY()
+	if err != nil {
+		p.tty.Close()
+		return nil, err
+	}
+	p.ptm = ptm
+	defer pts.Close() // the command has its own copy once it starts
+	if err := copySize(p.tty, pts); err != nil {
+		p.close()
+		return nil, fmt.Errorf("could not get size of terminal %s: %w", tty, err)
+	}
+
+	p.cmd = exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	p.cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		p.cmd.Env = append(os.Environ(), c.Env...)
+	}
+	p.cmd.Stdin, p.cmd.Stdout, p.cmd.Stderr = pts, pts, pts
+	// Make the pseudo-terminal (the child's stdin) its controlling terminal.
+	// The child leads a new session, so it's also in its own process group
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	p.cmd.Cancel = func() error {
+		return syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+	}
+	p.cmd.WaitDelay = waitDelay
+
+	if p.saved, err = makeRaw(p.tty); err != nil {
+		p.close()
+		return nil, fmt.Errorf("could not put terminal %s in raw mode: %w", tty,
+			err)
+	}
+	if err := p.cmd.Start(); err != nil {
+		restore(p.tty, p.saved)
+		p.close()
+		return nil, err
+	}
+
+	// Forward resizes of the user's terminal, and copy input and output
+	signal.Notify(p.winch, syscall.SIGWINCH)
+	go func() {
+		for {
+			select {
+			case <-p.winch:
+				copySize(p.tty, p.ptm)
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	go io.Copy(p.ptm, p.tty) // returns once Wait() closes p.tty
+	go func() {
+		io.Copy(p.tty, p.ptm) // returns once every copy of pts is closed
+		close(p.output)
+	}()
+	return p, nil
+}
+
+// Wait implements the Process interface. Once the command exits, it restores
+// the user's terminal.
+func (p *terminalProcess) Wait() error {
+	err := p.cmd.Wait()
+	// The command's output may still be buffered in the pseudo-terminal (or, if
+	// the command left a child running, the pseudo-terminal may stay open)
+	select {
+	case <-p.output:
+	case <-time.After(waitDelay):
+	}
+	signal.Stop(p.winch)
+	close(p.done)
+	if rerr := restore(p.tty, p.saved); rerr != nil && err == nil {
+		err = fmt.Errorf("could not restore terminal: %w", rerr)
+	}
+	p.close()
+	return err
+}
+
+// processState returns the state of the command once it has exited (see
+// processState() in usage.go)
+func (p *terminalProcess) processState() *os.ProcessState {
+	return p.cmd.ProcessState
+}
+
+// close closes the files held by 'p'
+func (p *terminalProcess) close() {
+	p.tty.Close()
+	p.ptm.Close()
+}
@@ -0,0 +1,97 @@
+package op
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readUntil reads from 'r' until it has read a line containing 'want', and
+// fails the test if that takes too long
+func readUntil(t *testing.T, r *bufio.Reader, want string) {
+	t.Helper()
+	found := make(chan bool, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if strings.Contains(line, want) {
+				found <- true
+				return
+			}
+			if err != nil {
+				found <- false
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Fatalf("terminal closed before %q was written", want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	// Use a pseudo-terminal as the "user's terminal", so that the test can
+	// type into it and read what the command prints
+	user, term, err := openPTY()
+	if err != nil {
+		t.Skipf("could not open pseudo-terminal: %v", err)
+	}
+	defer user.Close()
+	defer term.Close()
+	setSize := func(rows, cols uint16) {
+		if err := control(term, func(fd int) error {
+			return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ,
+				&unix.Winsize{Row: rows, Col: cols})
+		}); err != nil {
+			t.Fatalf("could not set terminal size: %v", err)
+		}
+	}
+	setSize(30, 100)
+	var before *unix.Termios
+	control(term, func(fd int) (err error) {
+		before, err = unix.IoctlGetTermios(fd, unix.TCGETS)
+		return err
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		o := StartOp().Executor(OSExecutor{TTY: term.Name()}).Interactive()
+		o.Run("sh", "-c", "test -t 0 && stty size && read x && "+
+			"echo \"got $x\" && stty size")
+		errs <- o.DetailedError()
+	}()
+	r := bufio.NewReader(user)
+	readUntil(t, r, "30 100")
+
+	// Resize the user's terminal, and type a line (in raw mode, "\r" reaches
+	// the command's pseudo-terminal, which translates it to "\n")
+	setSize(40, 120)
+	syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	time.Sleep(100 * time.Millisecond)
+	user.Write([]byte("hello\r"))
+	readUntil(t, r, "got hello")
+	readUntil(t, r, "40 120")
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	var after *unix.Termios
+	control(term, func(fd int) (err error) {
+		after, err = unix.IoctlGetTermios(fd, unix.TCGETS)
+		return err
+	})
+	if *after != *before {
+		t.Fatalf("expected terminal to be restored to %+v, but got %+v", before,
+			after)
+	}
+}
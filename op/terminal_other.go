@@ -0,0 +1,14 @@
+//go:build !linux
+
+package op
+
+import (
+	"context"
+	"errors"
+)
+
+// startTerminal starts 'c' in a pseudo-terminal. It's only implemented on
+// Linux (see terminal_linux.go)
+func startTerminal(ctx context.Context, tty string, c *Cmd) (Process, error) {
+	return nil, errors.New("interactive commands are only supported on Linux")
+}
@@ -0,0 +1,184 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTranscriptOutput is the number of bytes of each command's stderr (and
+// stdout, with TranscribeStdout()) that are kept in its TranscriptEntry
+const maxTranscriptOutput = 4096
+
+// TranscriptEntry describes one step (a command, pipeline, or 'cd') run by
+// an Op. See RecordTranscript().
+type TranscriptEntry struct {
+	Args     []string      `json:"args"`
+	Dir      string        `json:"dir,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+
+	// The command's exit code, or -1 if it didn't exit normally (e.g. it
+	// couldn't be started or was killed by a signal)
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+
+	// The resources used by the command (see Usage)
+	User   time.Duration `json:"user,omitempty"`
+	System time.Duration `json:"system,omitempty"`
+	MaxRSS int64         `json:"max_rss,omitempty"`
+
+	// If the Op has a retry policy (see Retry()), which attempt at running the
+	// command this was
+	Attempt int `json:"attempt,omitempty"`
+
+	// The beginning of the command's stdout and stderr (see
+	// maxTranscriptOutput). Stdout is only recorded if the Op was told to with
+	// TranscribeStdout().
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// String formats 'e' as a one-line summary (e.g. for printing with -v)
+func (e TranscriptEntry) String() string {
+	dir := ""
+	if e.Dir != "" {
+		dir = " (in " + e.Dir + ")"
+	}
+	status := fmt.Sprintf("exit %d", e.ExitCode)
+	if e.Error != "" && e.ExitCode <= 0 {
+		status = e.Error
+	}
+	return fmt.Sprintf("+ %s%s [%s, %v]", strings.Join(e.Args, " "), dir,
+		status, e.Duration.Round(time.Millisecond))
+}
+
+// JSONLines returns a transcript observer (see RecordTranscript()) that
+// writes each entry to 'w' as a line of JSON. It's safe to share between Ops
+// running concurrently.
+func JSONLines(w io.Writer) func(TranscriptEntry) {
+	var mu sync.Mutex
+	e := json.NewEncoder(w)
+	return func(entry TranscriptEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		e.Encode(entry) // best-effort: transcripts are for debugging
+	}
+}
+
+// RecordTranscript directs 'o' to record a TranscriptEntry for each
+// subsequent step that it runs (see Transcript()), and to pass each entry to
+// 'observers' as the step finishes (e.g. to print or log it). Entries include
+// each step's stderr and exit status, but not its stdout, which often holds
+// file contents or other data that shouldn't end up in logs (see
+// TranscribeStdout()).
+func (o *Op) RecordTranscript(observers ...func(TranscriptEntry)) *Op {
+	o.transcribe = true
+	o.observers = append(o.observers, observers...)
+	return o
+}
+
+// TranscribeStdout directs 'o' to also record the beginning of each
+// subsequent step's stdout in its TranscriptEntry
+func (o *Op) TranscribeStdout() *Op {
+	o.transcribeStdout = true
+	return o
+}
+
+// Transcript returns an entry for each step that 'o' has run since
+// RecordTranscript() was called
+func (o *Op) Transcript() []TranscriptEntry {
+	return o.transcript
+}
+
+// prefixBuffer is an io.Writer that keeps the first 'limit' bytes written to
+// it and discards the rest
+type prefixBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.buf); room < len(p) {
+		b.buf = append(b.buf, p[:room]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (b *prefixBuffer) String() string {
+	if b.truncated {
+		return string(b.buf) + "...(truncated)"
+	}
+	return string(b.buf)
+}
+
+// stepTrace tracks a step while it runs, for the Op's transcript
+type stepTrace struct {
+	entry  TranscriptEntry
+	stdout *prefixBuffer // nil unless the Op transcribes stdout
+}
+
+// beginStep starts tracing a step that runs 'args'. It returns nil if 'o'
+// isn't recording a transcript.
+func (o *Op) beginStep(args []string) *stepTrace {
+	if !o.transcribe || o.dryRun {
+		return nil
+	}
+	t := &stepTrace{
+		entry: TranscriptEntry{
+			Args:  append([]string(nil), args...),
+			Dir:   o.dir,
+			Start: time.Now(),
+		},
+	}
+	if o.transcribeStdout {
+		t.stdout = &prefixBuffer{limit: maxTranscriptOutput}
+	}
+	return t
+}
+
+// stdoutFor returns the writer that a traced command's stdout should be
+// connected to: 'w' (which may be nil), teed into the trace if the Op
+// transcribes stdout
+func (t *stepTrace) stdoutFor(w io.Writer) io.Writer {
+	if t == nil || t.stdout == nil {
+		return w
+	}
+	if w == nil {
+		return t.stdout
+	}
+	return io.MultiWriter(w, t.stdout)
+}
+
+// endStep finishes tracing a step, which wrote 'stderr' and returned 'err',
+// and adds it to the Op's transcript
+func (o *Op) endStep(t *stepTrace, stderr []byte, err error) {
+	if t == nil {
+		return
+	}
+	e := t.entry
+	e.Duration = time.Since(e.Start)
+	if t.stdout != nil {
+		e.Stdout = t.stdout.String()
+	}
+	if len(stderr) > maxTranscriptOutput {
+		e.Stderr = string(stderr[:maxTranscriptOutput]) + "...(truncated)"
+	} else {
+		e.Stderr = string(stderr)
+	}
+	if err != nil {
+		e.Error = err.Error()
+		e.ExitCode, _ = exitStatus(err)
+	}
+	o.transcript = append(o.transcript, e)
+	for _, observe := range o.observers {
+		observe(e)
+	}
+}
@@ -0,0 +1,95 @@
+package op
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Usage describes the resources used by one step (a command or pipeline) run
+// by an Op. See Op.Usage().
+type Usage struct {
+	Args []string
+
+	Wall   time.Duration // elapsed real time
+	User   time.Duration // user CPU time
+	System time.Duration // system CPU time
+
+	// The peak resident set size of the command (or, for pipelines, of the
+	// largest stage), in bytes. Like the CPU times, this includes any
+	// children that the command waited for.
+	MaxRSS int64
+}
+
+// String formats 'u' as a one-line summary
+func (u Usage) String() string {
+	return fmt.Sprintf("%s [wall %v, user %v, sys %v, max rss %.1f MiB]",
+		strings.Join(u.Args, " "), u.Wall.Round(time.Millisecond),
+		u.User.Round(time.Millisecond), u.System.Round(time.Millisecond),
+		float64(u.MaxRSS)/(1<<20))
+}
+
+// Usage returns the resources used by each command and pipeline that 'o' has
+// run (including each attempt at running commands that were retried)
+func (o *Op) Usage() []Usage {
+	return o.usage
+}
+
+// OnUsage directs 'o' to call 'f' with the resources used by each subsequent
+// command or pipeline, once it exits. 'f' may be called concurrently by Ops
+// that share it.
+func (o *Op) OnUsage(f func(Usage)) *Op {
+	o.usageObservers = append(o.usageObservers, f)
+	return o
+}
+
+// processState returns the state of 'p' after it has exited, or nil if it's
+// not an OS process (e.g. it was started by a FakeExecutor)
+func processState(p Process) *os.ProcessState {
+	switch p := p.(type) {
+	case *exec.Cmd:
+		return p.ProcessState
+	case interface{ processState() *os.ProcessState }:
+		return p.processState()
+	}
+	return nil
+}
+
+// recordUsage records the resources used by the step 'args', which started
+// at 'start' and ran 'procs' (which have all exited; some may be nil if they
+// couldn't be started), and adds them to 't' (if the step is being traced)
+func (o *Op) recordUsage(t *stepTrace, args []string, start time.Time,
+	procs ...Process) {
+	u := Usage{Args: append([]string(nil), args...), Wall: time.Since(start)}
+	for _, p := range procs {
+		if p == nil {
+			continue
+		}
+		state := processState(p)
+		if state == nil {
+			continue
+		}
+		u.User += state.UserTime()
+		u.System += state.SystemTime()
+		if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+			maxRSS := int64(ru.Maxrss)
+			if runtime.GOOS != "darwin" {
+				maxRSS *= 1024 // Linux reports ru_maxrss in KiB, macOS in bytes
+			}
+			if maxRSS > u.MaxRSS {
+				u.MaxRSS = maxRSS
+			}
+		}
+	}
+	if t != nil {
+		t.entry.User, t.entry.System, t.entry.MaxRSS = u.User, u.System, u.MaxRSS
+	}
+	o.usage = append(o.usage, u)
+	for _, observe := range o.usageObservers {
+		observe(u)
+	}
+}
@@ -0,0 +1,207 @@
+package op
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// varName matches valid variable names (which are also valid bash variable
+// names, so that Script() can refer to them)
+var /* const */ varName = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+// varRef matches a reference to a variable in a command's arguments, or an
+// escaped reference (preceded by a backslash), which stands for itself
+var /* const */ varRef = regexp.MustCompile(`\\?\{\{([A-Za-z_]\w*)\}\}`)
+
+// capture is a variable that the Op's next step will set (see Capture())
+type capture struct {
+	name   string
+	re     *regexp.Regexp // if nil, the step's whole (trimmed) stdout is stored
+	stdout bytes.Buffer
+}
+
+// Capture directs 'o' to store the stdout of its next step (a call to Run()
+// or Pipe()), with leading and trailing whitespace trimmed, in the variable
+// 'name'. If the Op expands variables (see ExpandVars()), later steps can
+// refer to the variable in their arguments as "{{name}}", e.g.:
+//
+//	o.ExpandVars()
+//	o.Capture("base").Run("git", "merge-base", "HEAD", "master")
+//	o.Run("git", "diff", "{{base}}", "HEAD")
+//
+// The step's stdout is still written to the Op's output (if any).
+func (o *Op) Capture(name string) *Op {
+	return o.CaptureMatch(name, nil)
+}
+
+// CaptureMatch is like Capture(), but stores the first group of 're' in the
+// next step's stdout (or its whole match, if 're' has no groups). If 're'
+// doesn't match, the step fails.
+func (o *Op) CaptureMatch(name string, re *regexp.Regexp) *Op {
+	if !varName.MatchString(name) {
+		if o.err == nil {
+			o.action = "could not capture output"
+			o.err = fmt.Errorf("invalid variable name %q", name)
+		}
+		return o
+	}
+	o.capture = &capture{name: name, re: re}
+	return o
+}
+
+// ExpandVars directs 'o' to replace each reference to a variable ("{{name}}";
+// see Capture() and SetVar()) in the arguments of subsequent commands with the
+// variable's value. Referring to a variable that isn't set is an error (see
+// ErrUndefinedVariable). A reference preceded by a backslash ("\\{{name}}")
+// is left as-is, minus the backslash.
+//
+// Ops don't expand variables unless this is called, so that arguments that
+// happen to contain "{{...}}" (e.g. Go templates, as in 'go list -f') are
+// passed to commands unchanged.
+func (o *Op) ExpandVars() *Op {
+	o.expandVars = true
+	return o
+}
+
+// SetVar sets the variable 'name' (see Capture()) to 'value'
+func (o *Op) SetVar(name, value string) *Op {
+	if !varName.MatchString(name) {
+		if o.err == nil {
+			o.action = "could not set variable"
+			o.err = fmt.Errorf("invalid variable name %q", name)
+		}
+		return o
+	}
+	if o.vars == nil {
+		o.vars = make(map[string]string)
+	}
+	o.vars[name] = value
+	delete(o.dryRunVars, name)
+	return o
+}
+
+// Var returns the value of the variable 'name' (see Capture()), and whether
+// it's set. Variables captured in dry-run mode aren't set, as their commands
+// didn't run.
+func (o *Op) Var(name string) (string, bool) {
+	value, ok := o.vars[name]
+	return value, ok
+}
+
+// takeCapture returns the Op's pending capture (if any), which applies to
+// the step that's starting
+func (o *Op) takeCapture() *capture {
+	c := o.capture
+	o.capture = nil
+	return c
+}
+
+// expand replaces each reference to a variable in 'args' with its value (if
+// the Op expands variables; see ExpandVars()). It also returns 'args' as a
+// line of bash, in which references to variables captured in dry-run mode
+// (whose values are unknown) are bash variable references.
+func (o *Op) expand(args []string) ([]string, string, error) {
+	if !o.expandVars {
+		return args, shellCommand(args), nil
+	}
+	expanded := make([]string, len(args))
+	words := make([]string, len(args))
+	for i, arg := range args {
+		var value, word strings.Builder
+		lit, last := "", 0 // the part of 'arg' not yet added to 'word'
+		for _, m := range varRef.FindAllStringSubmatchIndex(arg, -1) {
+			name := arg[m[2]:m[3]]
+			value.WriteString(arg[last:m[0]])
+			lit += arg[last:m[0]]
+			last = m[1]
+			if arg[m[0]] == '\\' {
+				// An escaped reference: keep it, minus the backslash
+				value.WriteString(arg[m[0]+1 : m[1]])
+				lit += arg[m[0]+1 : m[1]]
+			} else if v, ok := o.vars[name]; ok {
+				value.WriteString(v)
+				lit += v
+			} else if o.dryRunVars[name] {
+				value.WriteString("${" + name + "}")
+				if lit != "" {
+					word.WriteString(shellQuote(lit))
+				}
+				word.WriteString(`"${` + name + `}"`)
+				lit = ""
+			} else {
+				return nil, "", fmt.Errorf("%w %q", ErrUndefinedVariable, name)
+			}
+		}
+		value.WriteString(arg[last:])
+		lit += arg[last:]
+		if lit != "" || word.Len() == 0 {
+			word.WriteString(shellQuote(lit))
+		}
+		expanded[i], words[i] = value.String(), word.String()
+	}
+	return expanded, strings.Join(words, " "), nil
+}
+
+// scriptLine returns the line of bash that records 'cmd' in the Op's script,
+// assigning its output to the captured variable (if any)
+func (c *capture) scriptLine(cmd string) string {
+	if c == nil {
+		return cmd
+	}
+	return c.name + "=$(" + cmd + ")"
+}
+
+// stdoutFor returns the writer that a step's stdout should be connected to:
+// 'w' (which may be nil), teed into the capture
+func (c *capture) stdoutFor(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	c.stdout.Reset() // in case the step is retried
+	if w == nil {
+		return &c.stdout
+	}
+	return io.MultiWriter(w, &c.stdout)
+}
+
+// dryRunCapture marks the variable set by 'c' (if any) as captured in
+// dry-run mode
+func (o *Op) dryRunCapture(c *capture) {
+	if c == nil {
+		return
+	}
+	if o.dryRunVars == nil {
+		o.dryRunVars = make(map[string]bool)
+	}
+	o.dryRunVars[c.name] = true
+	delete(o.vars, c.name)
+}
+
+// endCapture stores the output captured by 'c' (if any) in its variable, and
+// records it in 'entry', so that it's restored if a later run of the Op skips
+// the step (see Journal())
+func (o *Op) endCapture(c *capture, entry *journalEntry) error {
+	if c == nil {
+		return nil
+	}
+	value := strings.TrimSpace(c.stdout.String())
+	if c.re != nil {
+		m := c.re.FindStringSubmatch(c.stdout.String())
+		if m == nil {
+			o.action = "could not capture " + c.name
+			o.err = fmt.Errorf("output does not match %v: %q", c.re,
+				value)
+			return o.err
+		}
+		value = m[0]
+		if len(m) > 1 {
+			value = m[1]
+		}
+	}
+	o.SetVar(c.name, value)
+	entry.Vars = map[string]string{c.name: value}
+	return nil
+}
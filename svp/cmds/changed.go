@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"os/exec"
 	"regexp"
 	"strings"
 
@@ -47,28 +46,57 @@ func last(b []byte) byte {
 // All files are relative to the root of the current git repo. Used by
 // modifiedFiles()
 func uncommittedFiles() (map[string]struct{}, error) {
-	cmdString := "git status --porcelain"
-	statusCmd := exec.Command("git", "status", "--porcelain")
-	statusOutput, err := statusCmd.Output()
+	return uncommittedFilesIn("")
+}
+
+// uncommittedFilesIn is like uncommittedFiles(), but it runs 'git status' in
+// the git repo at 'dir' instead of the current directory (if 'dir' is empty,
+// it uses the current directory). All files are relative to the root of that
+// repo.
+func uncommittedFilesIn(dir string) (map[string]struct{}, error) {
+	statuses, err := fileStatuses(dir)
 	if err != nil {
-		return nil, fmt.Errorf("Could not get files from git status: (\"%s\"):\n%s",
-			cmdString, err)
+		return nil, err
 	}
 	files := make(map[string]struct{})
-	for s := bufio.NewScanner(bytes.NewReader(statusOutput)); s.Scan(); {
-		// Skip blank lines in status
-		if len(bytes.TrimSpace(s.Bytes())) == 0 {
-			continue
-		}
-
+	for filename, status := range statuses {
 		// Skip files that are in the workding directory but haven't been added
 		// to the index yet (usually logs and scripts. line starts with ??)
-		status := string(s.Bytes()[:2])
 		if status == "??" {
 			continue
 		}
+		// Ignore files that we change automatically in every client
+		if _, boring := alwaysModified[filename]; !boring {
+			files[filename] = struct{}{}
+		}
+	}
+	return files, nil
+}
+
+// fileStatuses returns every file listed by 'git status --porcelain' in the
+// git repo at 'dir' (or the current repo, if 'dir' is empty), mapped to its
+// two-letter status (e.g. " M", or "??" for untracked files). Unlike
+// uncommittedFilesIn(), it doesn't skip any files, so it's suitable for
+// checking whether a repo can be safely deleted.
+func fileStatuses(dir string) (map[string]string, error) {
+	op := queryOp()
+	op.CollectStdOut()
+	if dir != "" {
+		op.Dir(dir)
+	}
+	op.RunWithRetry(gitRetry, "git", "status", "--porcelain")
+	if err := op.DetailedError(); err != nil {
+		return nil, fmt.Errorf("Could not get files from git status:\n%w", err)
+	}
+	files := make(map[string]string)
+	for s := bufio.NewScanner(strings.NewReader(op.Output())); s.Scan(); {
+		// Skip blank lines in status
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
 
 		// Extract filename from status line
+		status := string(s.Bytes()[:2])
 		filename := s.Bytes()[3:]
 		if bytes.Contains(filename, arrow) {
 			filename = bytes.Split(filename, arrow)[1]
@@ -78,12 +106,7 @@ func uncommittedFiles() (map[string]struct{}, error) {
 		if len(filename) > 0 && filename[0] == byte('"') && last(filename) == byte('"') {
 			filename = slashRe.ReplaceAllLiteral(filename[1:len(filename)-1], nil)
 		}
-
-		// Ignore files that we change automatically in every client
-		filenameStr := string(filename)
-		if _, boring := alwaysModified[filenameStr]; !boring {
-			files[filenameStr] = struct{}{}
-		}
+		files[string(filename)] = status
 	}
 	return files, nil
 }
@@ -131,18 +154,16 @@ func uncommittedFiles() (map[string]struct{}, error) {
 
 func committedFiles(left, right string) (map[string]struct{}, error) {
 	// Get files changed between 'left' and 'right'
-	cmd := []string{"git", "diff", "--name-only", left, right}
-	cmdString := strings.Join(cmd, " ")
-	diffCmd := exec.Command(cmd[0], cmd[1:]...)
-	diffCmdOutput, err := diffCmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("Could not get commit log (\"%s\"):\n%s", cmdString,
-			err)
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run("git", "diff", "--name-only", left, right)
+	if err := op.DetailedError(); err != nil {
+		return nil, fmt.Errorf("Could not get commit log:\n%w", err)
 	}
 
 	// put files into map for deduping
 	files := make(map[string]struct{})
-	for s := bufio.NewScanner(bytes.NewBuffer(diffCmdOutput)); s.Scan(); {
+	for s := bufio.NewScanner(strings.NewReader(op.Output())); s.Scan(); {
 		if len(s.Bytes()) > 0 {
 			files[s.Text()] = struct{}{}
 		}
@@ -1,79 +1,360 @@
 package cmds
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/msteffen/pachyderm-tools/op"
 	"github.com/msteffen/pachyderm-tools/svp/config"
 
 	"github.com/spf13/cobra"
 )
 
-const clientNameRegex = "[a-zA-Z0-9_.-]+" // For printing in errors
-var /* const */ clientMatcher = regexp.MustCompile(clientNameRegex)
+// clientNameRegex matches valid client names. Names may not start with "." (so
+// that ".", ".." and ".svp" are never clients). It's also printed in errors.
+const clientNameRegex = "[a-zA-Z0-9_-][a-zA-Z0-9_.-]*"
 
-// TODO make this settable
-var clientTemplate string = "pachyderm"
+var /* const */ clientMatcher = regexp.MustCompile("^" + clientNameRegex + "$")
+
+// checkClientName returns an error if 'clientname' isn't a valid client name
+// (in particular, if it would refer to the clients directory itself, its
+// parent, or svp's own files in .svp)
+func checkClientName(clientname string) error {
+	if !clientMatcher.MatchString(clientname) {
+		return fmt.Errorf("client name must match %s but was %s", clientNameRegex,
+			clientname)
+	}
+	return nil
+}
+
+// fallbackTemplate is the template used by 'new-client' if neither --template
+// nor 'default_template' (in .svpconfig) is set
+const fallbackTemplate = "pachyderm"
+
+// resolveTemplate returns the name of the client template to use, given the
+// value of a command's --template flag. The flag takes precedence, followed by
+// 'default_template' in .svpconfig, followed by 'fallbackTemplate'
+func resolveTemplate(flag string) string {
+	switch {
+	case flag != "":
+		return flag
+	case config.Config.DefaultTemplate != "":
+		return config.Config.DefaultTemplate
+	default:
+		return fallbackTemplate
+	}
+}
+
+// createClient creates the client 'clientname' from 'template' (killing any
+// step that runs for longer than 'timeout', if set). If creating the client
+// fails partway through, the partially-created client is removed. If svp
+// dies partway through (so the client can't be removed), the finished steps
+// are journaled, so that re-running 'new-client' resumes where it left off.
+func createClient(clientname, template string, timeout time.Duration) error {
+	// Validate args
+	var (
+		templatePath = path.Join(config.Config.ClientDirectory,
+			".svp/templates", template)
+		updateTemplateScript = path.Join(config.Config.ClientDirectory,
+			".svp/update-template", template)
+		initClientScript = path.Join(config.Config.ClientDirectory,
+			".svp/init-new-client", template)
+		clientPath  = path.Join(config.Config.ClientDirectory, clientname)
+		journalPath = path.Join(config.Config.ClientDirectory,
+			".svp/journal/new-client", clientname)
+	)
+	if err := checkClientName(clientname); err != nil {
+		return err
+	}
+	if _, err := os.Stat(journalPath); err == nil {
+		fmt.Printf("resuming creation of client %s\n", clientname)
+	} else if _, err := os.Stat(clientPath); !os.IsNotExist(err) {
+		return fmt.Errorf("client %s already exists", clientname)
+	}
+	for _, p := range []string{templatePath, updateTemplateScript,
+		initClientScript} {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return fmt.Errorf("template %q is missing %s (each template needs "+
+				".svp/templates/%[1]s, .svp/update-template/%[1]s, and "+
+				".svp/init-new-client/%[1]s)", template, p)
+		} else if err != nil {
+			return fmt.Errorf("could not stat %s for template %q: %v", p,
+				template, err)
+		}
+	}
+
+	// Update template in preparation for creating a new client
+	op := startOp()
+	op.OutputTo(os.Stdout)
+	op.Timeout(timeout)
+	op.Journal(journalPath, os.Stdout)
+	op.Chdir(templatePath)
+	op.StepID("update-template").Run(updateTemplateScript)
+	op.Chdir(config.Config.ClientDirectory)
+	// If any later step fails (or svp is interrupted), delete the half-built
+	// client, so that 'new-client' can simply be re-run
+	op.Rollback("rm", "-rf", clientPath)
+	// -T and -f let this finish a copy that was interrupted (when resuming)
+	op.StepID("copy-template").Run("cp", "-r", "-l", "-f", "-T", templatePath,
+		clientPath)
+	op.Chdir(clientPath)
+	op.Setenv("GOPATH", clientPath) // the client is its own go workspace
+	op.StepID("init-client").Run(initClientScript)
+	err := op.DetailedError()
+	if err == nil {
+		return op.DiscardJournal()
+	}
+	_, statErr := os.Stat(clientPath)
+	if cleanupErr := op.Cleanup(); cleanupErr != nil {
+		// Keep the journal, so that re-running 'new-client' resumes
+		return fmt.Errorf("%w\nadditionally, could not remove the half-built "+
+			"client %s:\n%v", err, clientPath, cleanupErr)
+	}
+	if discardErr := op.DiscardJournal(); discardErr != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", discardErr)
+	}
+	if statErr == nil {
+		return fmt.Errorf("%w\n(removed the half-built client %s)", err,
+			clientPath)
+	}
+	return err
+}
 
 // newClient is a Cobra command that creates a new client for working on
 // Pachyderm in the pre-configured clients directory, and sets it up to begin
 // working
 func newClient() *cobra.Command {
 	var template string
+	var timeout time.Duration
 	newClientCmd := &cobra.Command{
 		Use:   "new-client",
 		Short: "Create a new client for working on Pachyderm",
 		Run: BoundedCommand(1, 1, func(args []string) error {
-			clientname := args[0]
-
-			// Validate args
-			var (
-				templatePath = path.Join(config.Config.ClientDirectory,
-					".svp/templates", clientTemplate)
-				updateTemplateScript = path.Join(config.Config.ClientDirectory,
-					".svp/update-template", clientTemplate)
-				initClientScript = path.Join(config.Config.ClientDirectory,
-					".svp/init-new-client", clientTemplate)
-				clientPath = path.Join(config.Config.ClientDirectory, clientname)
-				pachPath   = path.Join(clientPath, "src/github.com/pachyderm/pachyderm")
-			)
-			if !clientMatcher.MatchString(clientPath) {
-				return fmt.Errorf("client name must match %s but was %s", clientNameRegex,
-					clientPath)
-			}
-			if _, err := os.Stat(clientPath); !os.IsNotExist(err) {
-				return fmt.Errorf("client %s already exists", clientname)
-			}
-			if _, err := os.Stat(clientPath); err != nil {
-				return fmt.Errorf("could not stat template for %s: %v", clientname)
-			}
-
-			// Update template in preparation for creating a new client
-			op := op.StartOp()
-			op.OutputTo(os.Stdout)
-			op.Chdir(templatePath)
-			op.Run(updateTemplateScript)
-			op.Chdir(config.Config.ClientDirectory)
-			op.Run("cp", "-r", "-l", templatePath, clientPath)
-			op.Chdir(clientPath)
-			op.Run(initClientScript)
-			if _, err := os.Stat(pachPath); err == nil {
-				op.Chdir(pachPath)
-			}
-			return op.DetailedError()
+			return createClient(args[0], resolveTemplate(template), timeout)
 		}),
 	}
 	newClientCmd.Flags().StringVarP(&template, "template", "t", "", "The "+
-		"template to use for creating the new client")
+		"template to use for creating the new client (default: "+
+		"'default_template' in .svpconfig, or \""+fallbackTemplate+"\")")
+	newClientCmd.Flags().DurationVar(&timeout, "timeout", 0, "Kill any step "+
+		"of creating the client (e.g. the template's update script) that runs "+
+		"for longer than this (0 means no limit). With a timeout, the template's "+
+		"scripts can't prompt for input (e.g. an ssh passphrase)")
 	return newClientCmd
 }
 
+// clientRepos returns the paths of all git repos inside the client at
+// 'clientPath' (e.g. the pachyderm repo under src/github.com/pachyderm). svp
+// doesn't search inside of git repos, so submodules and vendored repos are
+// not returned
+func clientRepos(clientPath string) ([]string, error) {
+	var repos []string
+	err := filepath.Walk(clientPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(path.Join(p, ".git")); err == nil {
+			repos = append(repos, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not search %s for git repos: %v", clientPath,
+			err)
+	}
+	return repos, nil
+}
+
+// unsavedWork returns a description of each piece of work in the git repo
+// 'repo' that would be lost if the repo were deleted: uncommitted and
+// untracked files, commits that aren't on any remote, and stashes. If 'branch'
+// is set, commits in that branch aren't counted (e.g. because 'svp submit' is
+// about to push them).
+func unsavedWork(repo, branch string) ([]string, error) {
+	var work []string
+	statuses, err := fileStatuses(repo)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(statuses))
+	for file := range statuses {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if statuses[file] == "??" {
+			work = append(work, fmt.Sprintf("untracked file: %s", file))
+		} else {
+			work = append(work, fmt.Sprintf("uncommitted file: %s", file))
+		}
+	}
+
+	op := queryOp()
+	op.CollectStdOut()
+	op.Dir(repo)
+	// List commits (in any local branch) that aren't in any remote branch
+	args := []string{"git", "log", "--branches", "--not", "--remotes",
+		"--oneline"}
+	if branch != "" {
+		args = append(args, "refs/heads/"+branch) // also negated by --not
+	}
+	op.Run(args...)
+	for _, line := range strings.Split(strings.TrimSpace(op.Output()), "\n") {
+		if line != "" {
+			work = append(work, fmt.Sprintf("unpushed commit: %s", line))
+		}
+	}
+	op.Run("git", "stash", "list")
+	for _, line := range strings.Split(strings.TrimSpace(op.Output()), "\n") {
+		if line != "" {
+			work = append(work, fmt.Sprintf("stash: %s", line))
+		}
+	}
+	if err := op.DetailedError(); err != nil {
+		return nil, err
+	}
+	return work, nil
+}
+
+// confirmNoUnsavedWork checks every git repo in the client 'clientname' for
+// work that would be lost by deleting the client (see unsavedWork()). If
+// there is any, it lists the work and asks the user whether to delete the
+// client anyway, and returns an error unless they say yes. Commits in the
+// branch 'branch' of the repo 'repo' (if set) aren't counted. With --dry-run,
+// the work is listed, but the user isn't asked.
+func confirmNoUnsavedWork(clientname, repo, branch string) error {
+	clientPath := path.Join(config.Config.ClientDirectory, clientname)
+	repos, err := clientRepos(clientPath)
+	if err != nil {
+		return err
+	}
+	var work []string
+	for _, r := range repos {
+		b := ""
+		if r == repo {
+			b = branch
+		}
+		repoWork, err := unsavedWork(r, b)
+		if err != nil {
+			return fmt.Errorf("could not check %s for unsaved work:\n%w", r, err)
+		}
+		for _, w := range repoWork {
+			work = append(work, fmt.Sprintf("%s: %s", r, w))
+		}
+	}
+	if len(work) > 0 {
+		fmt.Printf("client %s contains work that would be lost:\n  %s\n",
+			clientname, strings.Join(work, "\n  "))
+		if DryRun {
+			return nil // don't wait for an answer; nothing will be deleted
+		}
+		if !confirm("Delete it anyway?") {
+			return fmt.Errorf("not deleting client %s", clientname)
+		}
+	}
+	return nil
+}
+
+// confirm prints 'prompt' and reads a yes/no answer from the user. Anything
+// other than "y" or "yes" is treated as "no"
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// removeClient runs the teardown script for 'template' (if there is one) in
+// the client 'clientname', and then deletes the client. If 'archiveDir' is
+// set, the client is moved into it instead of being deleted
+func removeClient(clientname, template, archiveDir string) error {
+	var (
+		teardownScript = path.Join(config.Config.ClientDirectory,
+			".svp/teardown-client", template)
+		clientPath = path.Join(config.Config.ClientDirectory, clientname)
+	)
+	// Never delete anything but a client (e.g. not ".svp", or "..")
+	if err := checkClientName(clientname); err != nil {
+		return err
+	}
+	op := startOp()
+	op.OutputTo(os.Stdout)
+	if _, err := os.Stat(teardownScript); err == nil {
+		op.Chdir(clientPath)
+		op.Run(teardownScript)
+	}
+	op.Chdir(config.Config.ClientDirectory)
+	if archiveDir != "" {
+		op.Run("mkdir", "-p", archiveDir)
+		op.Run("mv", clientPath, path.Join(archiveDir,
+			clientname+"-"+time.Now().Format("20060102-150405")))
+	} else {
+		op.Run("rm", "-rf", clientPath)
+	}
+	return op.DetailedError()
+}
+
+// deleteClientNamed deletes the client 'clientname' (created from
+// 'template'). Unless 'force' is set, it first checks the client for work that
+// would be lost, and asks the user whether to delete the client anyway.
+func deleteClientNamed(clientname, template string, force bool) error {
+	// Validate args
+	if err := checkClientName(clientname); err != nil {
+		return err
+	}
+	clientPath := path.Join(config.Config.ClientDirectory, clientname)
+	if _, err := os.Stat(clientPath); os.IsNotExist(err) {
+		return fmt.Errorf("client %s does not exist", clientname)
+	} else if err != nil {
+		return fmt.Errorf("could not stat client %s: %v", clientname, err)
+	}
+
+	// Check for work that would be lost by deleting the client
+	if !force {
+		if err := confirmNoUnsavedWork(clientname, "", ""); err != nil {
+			return err
+		}
+	}
+	return removeClient(clientname, template, "")
+}
+
+// deleteClient is a Cobra command that deletes a client from the
+// pre-configured clients directory, after checking that it doesn't contain any
+// work that hasn't been pushed
+func deleteClient() *cobra.Command {
+	var template string
+	var force bool
+	deleteClientCmd := &cobra.Command{
+		Use:   "delete-client <client>",
+		Short: "Delete a client, after checking that all work in it has been pushed",
+		Run: BoundedCommand(1, 1, func(args []string) error {
+			return deleteClientNamed(args[0], resolveTemplate(template), force)
+		}),
+	}
+	deleteClientCmd.Flags().StringVarP(&template, "template", "t", "", "The "+
+		"template that the client was created from (used to find its teardown "+
+		"script)")
+	deleteClientCmd.Flags().BoolVarP(&force, "force", "f", false, "Delete the "+
+		"client without checking for uncommitted or unpushed work")
+	return deleteClientCmd
+}
+
 // ClientCommands returns svp commands related to Pachyderm clients (e.g.
 // new-client and delete-client)
 func ClientCommands() []*cobra.Command {
 	// Add any flags here
-	return []*cobra.Command{newClient(), deleteClient}
+	return []*cobra.Command{newClient(), deleteClient(), listClients()}
 }
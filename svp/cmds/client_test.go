@@ -0,0 +1,249 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/config"
+)
+
+// clientDir points config.Config.ClientDirectory at a new temp dir for the
+// rest of the test
+func clientDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "svp-test-clients-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	prev := config.Config.ClientDirectory
+	config.Config.ClientDirectory = dir
+	t.Cleanup(func() {
+		config.Config.ClientDirectory = prev
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// mkdirs creates each of 'dirs' (relative to 'root')
+func mkdirs(t *testing.T, root string, dirs ...string) {
+	for _, d := range dirs {
+		if err := os.MkdirAll(path.Join(root, d), 0755); err != nil {
+			t.Fatalf("could not create %s: %v", d, err)
+		}
+	}
+}
+
+// makeTemplate creates the client template 'name' in the clients directory
+// 'dir', with no-op update and init scripts
+func makeTemplate(t *testing.T, dir, name string) {
+	mkdirs(t, dir, ".svp/templates/"+name)
+	for _, script := range []string{"update-template", "init-new-client"} {
+		mkdirs(t, dir, ".svp/"+script)
+		p := path.Join(dir, ".svp", script, name)
+		if err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteClientUnsavedWork(t *testing.T) {
+	dir := clientDir(t)
+	repo := path.Join(dir, "foo/src/github.com/x/y")
+	mkdirs(t, repo+"/.git")
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "status", "--porcelain").InDir(repo).
+		Returns(" M main.go\n?? newfeature.go\n M Dockerfile\n")
+	fake.Expect("git", "log", "--branches", "--not", "--remotes", "--oneline").
+		InDir(repo).Returns("1234567 wip\n")
+	fake.Expect("git", "stash", "list").InDir(repo)
+
+	work, err := unsavedWork(repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unlike 'svp changed', this must report untracked files and files that
+	// svp modifies in every client, as deleting the client would lose them
+	want := "uncommitted file: Dockerfile\nuncommitted file: main.go\n" +
+		"untracked file: newfeature.go\nunpushed commit: 1234567 wip"
+	if strings.Join(work, "\n") != want {
+		t.Fatalf("expected unsaved work:\n%s\nbut got:\n%s", want,
+			strings.Join(work, "\n"))
+	}
+}
+
+func TestRemoveClient(t *testing.T) {
+	dir := clientDir(t)
+	mkdirs(t, dir, "foo", ".svp/teardown-client")
+	teardown := path.Join(dir, ".svp/teardown-client/tmpl")
+	if err := ioutil.WriteFile(teardown, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect(teardown).InDir(path.Join(dir, "foo"))
+	fake.Expect("rm", "-rf", path.Join(dir, "foo")).InDir(dir)
+	if err := removeClient("foo", "tmpl", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveClientTeardownFails(t *testing.T) {
+	dir := clientDir(t)
+	mkdirs(t, dir, "foo", ".svp/teardown-client")
+	teardown := path.Join(dir, ".svp/teardown-client/tmpl")
+	if err := ioutil.WriteFile(teardown, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// If the teardown script fails, the client must not be deleted
+	fake := op.UseFakeExecutor(t)
+	fake.Expect(teardown).Fails(1, "cluster still running")
+	err := removeClient("foo", "tmpl", "")
+	if err == nil || !strings.Contains(err.Error(), "cluster still running") {
+		t.Fatalf("expected teardown error, but got: %v", err)
+	}
+}
+
+func TestCreateClientRollback(t *testing.T) {
+	dir := clientDir(t)
+	makeTemplate(t, dir, "tmpl")
+	templatePath, clientPath := path.Join(dir, ".svp/templates/tmpl"),
+		path.Join(dir, "foo")
+
+	// The init script fails after the client has been copied from the
+	// template, so the client must be removed
+	fake := op.UseFakeExecutor(t)
+	fake.Expect(path.Join(dir, ".svp/update-template/tmpl"))
+	fake.Expect("cp", "-r", "-l", "-f", "-T", templatePath, clientPath).
+		Do(func(*op.Cmd) { mkdirs(t, dir, "foo") })
+	fake.Expect(path.Join(dir, ".svp/init-new-client/tmpl")).
+		Fails(1, "could not build pachd")
+	fake.Expect("rm", "-rf", clientPath).InDir(dir)
+
+	err := createClient("foo", "tmpl", 0)
+	if err == nil || !strings.Contains(err.Error(), "could not build pachd") ||
+		!strings.Contains(err.Error(), "removed the half-built client") {
+		t.Fatalf("expected init error and rollback, but got: %v", err)
+	}
+}
+
+func TestCreateClientResume(t *testing.T) {
+	dir := clientDir(t)
+	makeTemplate(t, dir, "tmpl")
+	mkdirs(t, dir, "foo")
+
+	// A previous run updated the template and died while copying it
+	journal := path.Join(dir, ".svp/journal/new-client/foo")
+	mkdirs(t, dir, ".svp/journal/new-client")
+	entry := `{"id":"update-template","args":["` +
+		path.Join(dir, ".svp/update-template/tmpl") + `"],"dir":"` +
+		path.Join(dir, ".svp/templates/tmpl") + `"}` + "\n"
+	if err := ioutil.WriteFile(journal, []byte(entry), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("cp", "-r", "-l", "-f", "-T", path.Join(dir,
+		".svp/templates/tmpl"), path.Join(dir, "foo"))
+	fake.Expect(path.Join(dir, ".svp/init-new-client/tmpl"))
+	if err := createClient("foo", "tmpl", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be removed, but got %v", err)
+	}
+}
+
+func TestNewClientCommand(t *testing.T) {
+	dir := clientDir(t)
+	makeTemplate(t, dir, "tmpl")
+	templatePath, clientPath := path.Join(dir, ".svp/templates/tmpl"),
+		path.Join(dir, "foo")
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect(path.Join(dir, ".svp/update-template/tmpl")).InDir(templatePath)
+	fake.Expect("cp", "-r", "-l", "-f", "-T", templatePath, clientPath).
+		InDir(dir).Do(func(*op.Cmd) { mkdirs(t, dir, "foo") })
+	fake.Expect(path.Join(dir, ".svp/init-new-client/tmpl")).InDir(clientPath)
+
+	for _, cmd := range ClientCommands() {
+		if cmd.Name() != "new-client" {
+			continue
+		}
+		cmd.SetArgs([]string{"--template", "tmpl", "foo"})
+		if err := cmd.Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConfirmNoUnsavedWork(t *testing.T) {
+	dir := clientDir(t)
+	repo := path.Join(dir, "foo/src/github.com/x/y")
+	mkdirs(t, repo, ".git")
+
+	// The user answers "no" when asked whether to delete the client anyway
+	stdin, err := ioutil.TempFile("", "svp-test-stdin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdin.Name())
+	stdin.WriteString("n\n")
+	stdin.Seek(0, 0)
+	defer func(prev *os.File) { os.Stdin = prev }(os.Stdin)
+	os.Stdin = stdin
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "status", "--porcelain").InDir(repo).
+		Returns("?? newfeature.go\n")
+	fake.Expect("git", "log", "--branches", "--not", "--remotes", "--oneline").
+		InDir(repo)
+	fake.Expect("git", "stash", "list").InDir(repo)
+	if err := confirmNoUnsavedWork("foo", "", ""); err == nil {
+		t.Fatal("expected client with an untracked file not to be deleted")
+	}
+
+	// With --dry-run, the work is listed, but the user isn't asked (stdin is
+	// now empty, so reading an answer would mean "no")
+	defer func(prev bool) { DryRun = prev }(DryRun)
+	DryRun = true
+	fake.Expect("git", "status", "--porcelain").InDir(repo).
+		Returns("?? newfeature.go\n")
+	fake.Expect("git", "log", "--branches", "--not", "--remotes", "--oneline").
+		InDir(repo)
+	fake.Expect("git", "stash", "list").InDir(repo)
+	if err := confirmNoUnsavedWork("foo", "", ""); err != nil {
+		t.Fatalf("expected --dry-run not to ask the user, but got %v", err)
+	}
+}
+
+func TestClientNamesStartingWithDot(t *testing.T) {
+	dir := clientDir(t)
+	makeTemplate(t, dir, "tmpl")
+	mkdirs(t, dir, "foo")
+	op.UseFakeExecutor(t) // no commands may run
+
+	// None of these may be treated as a client: "." is the clients directory,
+	// ".." is its parent, and ".svp" holds svp's templates and journals
+	for _, name := range []string{".", "..", ".svp", ".foo"} {
+		if err := createClient(name, "tmpl", 0); err == nil {
+			t.Errorf("expected new-client to refuse client name %q", name)
+		}
+		if err := deleteClientNamed(name, "tmpl", true); err == nil {
+			t.Errorf("expected delete-client to refuse client name %q", name)
+		}
+		if err := removeClient(name, "tmpl", ""); err == nil {
+			t.Errorf("expected removeClient to refuse client name %q", name)
+		}
+	}
+	for _, p := range []string{dir, path.Join(dir, ".svp/templates/tmpl"),
+		path.Join(dir, "foo")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("expected %s to still exist, but got %v", p, err)
+		}
+	}
+}
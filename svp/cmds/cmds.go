@@ -1,12 +1,313 @@
 package cmds
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/op"
 
 	"github.com/spf13/cobra"
 )
 
+// ctx is the context of every Op run by svp commands. It's canceled when svp
+// is interrupted, so that Ops kill the commands they're running (commands
+// with a timeout run in their own process groups, and so don't receive the
+// terminal's Ctrl-C themselves). A second interrupt kills svp immediately.
+var ctx, stopSignals = signal.NotifyContext(context.Background(),
+	os.Interrupt, syscall.SIGTERM)
+
+func init() {
+	go func() {
+		<-ctx.Done()
+		stopSignals() // restore default signal handling
+	}()
+}
+
+// DryRun is set by 'svp --dry-run'. If true, svp commands print the commands
+// they would run instead of running them (commands that only read state
+// still run; see queryOp())
+var DryRun bool
+
+// gitRetry retries git commands that fail because of transient problems:
+// network errors and another git process holding the repo's lock. It's only
+// used (via RunWithRetry()) for commands that are safe to run again, like 'git
+// fetch' and 'git status'; commands that change something (e.g. 'git push' or
+// 'git commit') may have partly succeeded, so they're never retried.
+var gitRetry = op.RetryPolicy{
+	MaxAttempts: 4,
+	Backoff:     time.Second,
+	MaxBackoff:  10 * time.Second,
+	Retryable: []*regexp.Regexp{
+		regexp.MustCompile(`index\.lock': File exists`),
+		regexp.MustCompile(`(?i)could not resolve host`),
+		regexp.MustCompile(`(?i)connection (timed out|reset|refused)`),
+		regexp.MustCompile(`(?i)early EOF|the remote end hung up unexpectedly`),
+		regexp.MustCompile(`(?i)operation timed out|temporary failure`),
+	},
+}
+
+// Verbose is set by 'svp -v'. If true, svp prints each command it runs (with
+// its exit code and duration) to stderr as the command finishes
+var Verbose bool
+
+// Timings is set by 'svp --timings'. If true, svp prints the time and memory
+// used by each command it ran (see printTimings()) before exiting
+var Timings bool
+
+// timings is the resource usage of every command run by this svp process, if
+// Timings is set
+var timings struct {
+	mu    sync.Mutex
+	usage []op.Usage
+}
+
+// recordTimings adds 'u' to 'timings'
+func recordTimings(u op.Usage) {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	timings.usage = append(timings.usage, u)
+}
+
+// printTimings prints a table of the resources used by each command that this
+// svp process ran (in the order they finished), and their total, to stderr
+func printTimings() {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	if !Timings || len(timings.usage) == 0 {
+		return
+	}
+	var total op.Usage
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "WALL\tUSER\tSYS\tMAX RSS\t\tCOMMAND")
+	row := func(u op.Usage, cmd string) {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.1f MiB\t\t%s\n",
+			u.Wall.Round(time.Millisecond), u.User.Round(time.Millisecond),
+			u.System.Round(time.Millisecond), float64(u.MaxRSS)/(1<<20), cmd)
+	}
+	for _, u := range timings.usage {
+		cmd := strings.Join(u.Args, " ")
+		if len(cmd) > 60 {
+			cmd = cmd[:57] + "..."
+		}
+		row(u, cmd)
+		total.Wall += u.Wall
+		total.User += u.User
+		total.System += u.System
+		if u.MaxRSS > total.MaxRSS {
+			total.MaxRSS = u.MaxRSS
+		}
+	}
+	row(total, fmt.Sprintf("(total of %d commands)", len(timings.usage)))
+	w.Flush()
+}
+
+// TranscriptDir is set by svp's main() to ~/.svp/logs. If set, every command
+// run by this svp process is logged there (see logTranscript()), and only the
+// newest maxTranscripts logs are kept
+var TranscriptDir string
+
+// transcript is the log of every command run by this svp process. It's
+// written as JSON lines (see op.TranscriptEntry) to a new file in
+// TranscriptDir, which is created when the first command finishes.
+var transcript struct {
+	once    sync.Once
+	path    string // empty if the log couldn't be created
+	observe func(op.TranscriptEntry)
+}
+
+// maxTranscripts is the number of transcripts that svp keeps in
+// TranscriptDir. When a new transcript is created, the oldest ones are
+// deleted.
+const maxTranscripts = 100
+
+// pruneTranscripts deletes all but the newest 'keep' transcripts in 'dir'.
+// Transcripts' names start with the time they were created, so they sort from
+// oldest to newest.
+func pruneTranscripts(dir string, keep int) {
+	infos, err := ioutil.ReadDir(dir) // sorted by name
+	if err != nil {
+		return
+	}
+	var logs []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".jsonl") {
+			logs = append(logs, info.Name())
+		}
+	}
+	for len(logs) > keep {
+		os.Remove(path.Join(dir, logs[0]))
+		logs = logs[1:]
+	}
+}
+
+// logTranscript appends 'e' to this svp process's transcript
+func logTranscript(e op.TranscriptEntry) {
+	transcript.once.Do(func() {
+		transcript.observe = func(op.TranscriptEntry) {}
+		if TranscriptDir == "" {
+			return
+		}
+		// Transcripts include commands' error output, which may be sensitive,
+		// so only the user may read them. Chmod in case an older svp created the
+		// directory.
+		if err := os.MkdirAll(TranscriptDir, 0700); err != nil {
+			return // transcripts are best-effort
+		}
+		os.Chmod(TranscriptDir, 0700)
+		pruneTranscripts(TranscriptDir, maxTranscripts-1)
+		p := path.Join(TranscriptDir, fmt.Sprintf("%s-%d.jsonl",
+			time.Now().Format("20060102-150405"), os.Getpid()))
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return
+		}
+		transcript.path, transcript.observe = p, op.JSONLines(f)
+	})
+	transcript.observe(e)
+}
+
+// startOp creates a new Op for an svp command. With --dry-run, the Op only
+// prints its commands, so it must only be used for commands that change
+// something (see queryOp())
+func startOp() *op.Op {
+	o := op.StartOpWithContext(ctx)
+	if DryRun {
+		o.DryRun(os.Stdout)
+	}
+	return traceOp(o)
+}
+
+// remoteOp is like startOp(), but for git commands that contact a remote
+// (e.g. 'git push' or 'git fetch'). svp usually collects or tees git's
+// output, so a prompt for a password or passphrase would hang where the user
+// can't see it. Instead, these commands fail right away (and svp prints a
+// hint; see failureHints). A GIT_SSH_COMMAND or GIT_SSH set by the user is
+// left alone.
+func remoteOp() *op.Op {
+	o := startOp()
+	o.Setenv("GIT_TERMINAL_PROMPT", "0")
+	if os.Getenv("GIT_SSH_COMMAND") == "" && os.Getenv("GIT_SSH") == "" {
+		o.Setenv("GIT_SSH_COMMAND", "ssh -o BatchMode=yes")
+	}
+	return o
+}
+
+// queryOp creates a new Op for commands that only read state (e.g. 'git
+// status', 'git log' or 'git rev-parse'). Unlike startOp(), it never
+// dry-runs: svp commands decide what to do based on the output of queries, so
+// even with --dry-run, queries must actually run.
+func queryOp() *op.Op {
+	return traceOp(op.StartOpWithContext(ctx))
+}
+
+// traceOp records the commands run by 'o' in svp's transcript (and, with -v
+// or --timings, prints them), and returns 'o'
+func traceOp(o *op.Op) *op.Op {
+	o.RecordTranscript(logTranscript)
+	if Timings {
+		o.OnUsage(recordTimings)
+	}
+	if Verbose {
+		o.RecordTranscript(func(e op.TranscriptEntry) {
+			fmt.Fprintln(os.Stderr, e)
+		})
+	}
+	return o
+}
+
+// failureHints are suggestions that svp prints when a command fails with
+// stderr matching one of these regexes
+var failureHints = []struct {
+	stderr *regexp.Regexp
+	hint   string
+}{
+	{regexp.MustCompile(`index\.lock': File exists`), "another git process " +
+		"seems to be running in this repo; if not, delete .git/index.lock"},
+	{regexp.MustCompile(`Permission denied \(publickey|Authentication failed|` +
+		`terminal prompts disabled`), "check that you can authenticate to " +
+		"the git remote without a prompt (e.g. with 'ssh -T git@github.com', " +
+		"or a credential helper for https remotes)"},
+	{regexp.MustCompile(`(?i)could not resolve host|connection (timed out|` +
+		`refused)`), "check your network connection"},
+}
+
+// Exit codes that svp uses for specific failures (following bash and
+// coreutils' 'timeout')
+const (
+	exitTimeout     = 124
+	exitNotFound    = 127
+	exitInterrupted = 130
+)
+
+// describeFailure returns the code that svp should exit with after 'cmd'
+// failed with 'err', and a hint for the user (if there is one)
+func describeFailure(cmd *cobra.Command, err error) (code int, hint string) {
+	// If some of a group's tasks failed (and the rest were canceled because of
+	// it), describe the first failure rather than the cancellations
+	var groupErr *op.GroupError
+	if errors.As(err, &groupErr) && len(groupErr.Failed) > 0 {
+		return describeFailure(cmd, groupErr.Failed[0].Err)
+	}
+	switch {
+	case errors.Is(err, op.ErrCanceled):
+		return exitInterrupted, ""
+	case errors.Is(err, op.ErrTimeout):
+		if cmd != nil && cmd.Flags().Lookup("timeout") != nil {
+			return exitTimeout, "use --timeout to allow more time"
+		}
+		return exitTimeout, ""
+	}
+	var opErr *op.Error
+	if !errors.As(err, &opErr) {
+		return 1, ""
+	}
+	var pathErr *fs.PathError
+	if errors.Is(opErr, exec.ErrNotFound) || errors.As(opErr, &pathErr) &&
+		pathErr.Op == "fork/exec" && errors.Is(pathErr, fs.ErrNotExist) {
+		return exitNotFound, fmt.Sprintf("is %s installed (and in $PATH)?",
+			opErr.Args[0])
+	}
+	for _, h := range failureHints {
+		if h.stderr.Match(opErr.Stderr) {
+			return 1, h.hint
+		}
+	}
+	return 1, ""
+}
+
+// exitWithError prints 'err', the error that 'cmd' failed with (along with a
+// hint, if there is one, and where to find the transcript of the commands that
+// led to it) and exits. Any cached client info that the command updated is
+// written first, as main() won't get the chance to.
+func exitWithError(cmd *cobra.Command, err error) {
+	if err := WriteCache(); err != nil {
+		log.Printf("could not write svp cache: %v", err)
+	}
+	code, hint := describeFailure(cmd, err)
+	fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	if hint != "" {
+		fmt.Fprintf(os.Stderr, "hint: %s\n", hint)
+	}
+	if transcript.path != "" {
+		fmt.Fprintf(os.Stderr, "(full transcript: %s)\n", transcript.path)
+	}
+	os.Exit(code)
+}
+
 // Command is the type of a command in svp
 type Command func([]string) error
 
@@ -14,9 +315,10 @@ type Command func([]string) error
 // slice of arguments and returning an error, and puts it in a cobra command
 func UnboundedCommand(f Command) func(*cobra.Command, []string) {
 	return func(cmd *cobra.Command, args []string) {
-		if err := f(args); err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-			os.Exit(1)
+		err := f(args)
+		printTimings()
+		if err != nil {
+			exitWithError(cmd, err)
 		}
 	}
 }
@@ -46,9 +348,9 @@ func BoundedCommand(minargs, maxargs int, f Command) func(*cobra.Command, []stri
 		default:
 			err = f(args)
 		}
+		printTimings()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 	}
 }
@@ -0,0 +1,168 @@
+package cmds
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+
+	"github.com/spf13/cobra"
+)
+
+func TestDescribeFailure(t *testing.T) {
+	failure := func(stderr string, args ...string) error {
+		fake := &op.FakeExecutor{}
+		fake.Expect(args...).Fails(128, stderr)
+		o := op.StartOp().Executor(fake)
+		o.Run(args...)
+		return fmt.Errorf("could not sync:\n%w", o.DetailedError())
+	}
+	missing := op.StartOp()
+	missing.Run("/does/not/exist")
+	timedOut := op.StartOp().Timeout(1)
+	timedOut.Run("sleep", "1")
+	interrupted, cancel := context.WithCancel(context.Background())
+	cancel()
+	canceled := op.NewGroup(interrupted, 0)
+	canceled.Run("sleep", "sleep", "1")
+	failFast := op.NewGroup(context.Background(), 1).CancelOnFailure()
+	failFast.Run("missing", "/does/not/exist")
+	failFast.Run("sleep", "sleep", "1")
+
+	for _, tc := range []struct {
+		err      error
+		wantCode int
+		wantHint bool
+	}{
+		{failure("fatal: Could not resolve host: github.com", "git", "fetch"), 1,
+			true},
+		{failure("fatal: could not read Username for 'https://github.com': "+
+			"terminal prompts disabled", "git", "push"), 1, true},
+		{failure("fatal: Unable to create '.git/index.lock': File exists.",
+			"git", "commit"), 1, true},
+		{failure("error: pathspec 'x' did not match", "git", "checkout", "x"), 1,
+			false},
+		{missing.DetailedError(), exitNotFound, true},
+		{timedOut.DetailedError(), exitTimeout, false},
+		{canceled.Wait(), exitInterrupted, false},
+		{failFast.Wait(), exitNotFound, true},
+		{fmt.Errorf("not an op error"), 1, false},
+	} {
+		code, hint := describeFailure(&cobra.Command{}, tc.err)
+		if code != tc.wantCode || (hint != "") != tc.wantHint {
+			t.Errorf("describeFailure(%q): expected code %d (hint: %t), but got %d "+
+				"(hint: %q)", tc.err, tc.wantCode, tc.wantHint, code, hint)
+		}
+	}
+	// The hint for a missing program in a pipeline names that program
+	pipeline := op.StartOp()
+	pipeline.Pipe([]string{"echo", "a b"}, []string{"/does/not/exist", "-x"})
+	code, hint := describeFailure(nil, pipeline.DetailedError())
+	if code != exitNotFound || !strings.HasPrefix(hint, "is /does/not/exist ") {
+		t.Errorf("expected a hint about /does/not/exist, but got %d (hint: %q)",
+			code, hint)
+	}
+
+	// Only commands with a --timeout flag suggest using it
+	withTimeout := &cobra.Command{}
+	withTimeout.Flags().Duration("timeout", 0, "")
+	code, hint = describeFailure(withTimeout, timedOut.DetailedError())
+	if code != exitTimeout || !strings.Contains(hint, "--timeout") {
+		t.Errorf("expected a hint about --timeout, but got %d (hint: %q)", code,
+			hint)
+	}
+}
+
+func TestQueriesIgnoreDryRun(t *testing.T) {
+	defer func(prev bool) { DryRun = prev }(DryRun)
+	DryRun = true
+
+	// With --dry-run, queries still run (so that svp can decide what to do),
+	// but commands that change something are only printed
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "status", "--porcelain").Returns(" M main.go\n")
+	files, err := uncommittedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]struct{}{"main.go": {}}; !reflect.DeepEqual(files,
+		want) {
+		t.Fatalf("expected uncommitted files %v, but got %v", want, files)
+	}
+	if err := startOp().Run("git", "stash", "push"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatestStash(t *testing.T) {
+	fake := op.UseFakeExecutor(t)
+	args := []string{"git", "rev-parse", "--verify", "-q", "refs/stash"}
+	fake.Expect(args...).Fails(1, "")
+	fake.Expect(args...).Returns("0123abcd\n")
+	fake.Expect(args...).Fails(128, "fatal: not a git repository")
+
+	for _, want := range []string{"", "0123abcd"} {
+		if got, err := latestStash(); err != nil || got != want {
+			t.Errorf("expected latest stash %q, but got %q (err: %v)", want, got,
+				err)
+		}
+	}
+	if got, err := latestStash(); err == nil {
+		t.Errorf("expected an error outside a git repo, but got stash %q", got)
+	}
+}
+
+func TestRemoteOpDoesNotPrompt(t *testing.T) {
+	t.Setenv("GIT_SSH_COMMAND", "")
+	t.Setenv("GIT_SSH", "")
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "push").Do(func(c *op.Cmd) {
+		env := strings.Join(c.Env, "\n") + "\n"
+		for _, want := range []string{"GIT_TERMINAL_PROMPT=0\n",
+			"GIT_SSH_COMMAND=ssh -o BatchMode=yes\n"} {
+			if !strings.Contains(env, want) {
+				t.Errorf("expected %q in the environment of 'git push', but got %q",
+					strings.TrimSpace(want), c.Env)
+			}
+		}
+	})
+	if err := remoteOp().Run("git", "push"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneTranscripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svp-test-logs-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	names := []string{"20240102-000000-3.jsonl", "20240101-000000-1.jsonl",
+		"20240103-000000-2.jsonl", "notes.txt"}
+	for _, name := range names {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruneTranscripts(dir, 1)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Name())
+	}
+	want := []string{"20240103-000000-2.jsonl", "notes.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v to be left, but got %v", want, got)
+	}
+}
@@ -14,10 +14,10 @@ import (
 	"github.com/msteffen/pachyderm-tools/svp/git"
 )
 
-// magicStr is the default value of the --skip flag. This lets us distinguish
-// between setting --skip="" (which we interpret as "don't filter") vs not
-// setting --skip at all (which we interpret as "use the config- or client-level
-// filter")
+// magicStr is the default value of the --skip, --branch and --tool flags. This
+// lets us distinguish between setting e.g. --skip="" (which we interpret as
+// "don't filter") vs not setting --skip at all (which we interpret as "use the
+// config- or client-level filter")
 const magicStr = `d0559e2982835732f88960cc0d87ca25914ff308dcf9247363c7a36537e6be35`
 
 var (
@@ -103,19 +103,10 @@ func vimdiff(tmpdir string, files []string, tmpfiles []*os.File) error {
 		return err
 	}
 
-	// Run 'vim' subprocess, with the generated vim script as input
-	cmd := exec.Command("vim", "-S", name)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	// open /dev/tty for vim; see [note] at the end
-	if tty, err := os.Open("/dev/tty"); err == nil {
-		cmd.Stdin = tty
-	} else {
-		fmt.Fprintf(os.Stderr, "could not use /dev/tty as vim input (you may have "+
-			"to run 'reset' afterwards: %s\n", err)
-	}
-	err = cmd.Run()
-	return err
+	// Run 'vim' in a pseudo-terminal, with the generated vim script as input
+	op := startOp().Interactive()
+	op.Run("vim", "-S", name)
+	return op.DetailedError()
 }
 
 var diffFn = map[string]func(string, []string, []*os.File) error{
@@ -128,6 +119,13 @@ var diffFn = map[string]func(string, []string, []*os.File) error{
 // 2) creates a temporary file 'tmpdir'
 // 3) write the data from (1) into file from (2)
 func makeDiffTempFile(branch, tmpdir, file string) (*os.File, error) {
+	return makeDiffTempFileWith(queryOp(), branch, tmpdir, file)
+}
+
+// makeDiffTempFileWith is like makeDiffTempFile(), but it runs 'git show' with
+// 'op' (e.g. so that it can run in an op.Group)
+func makeDiffTempFileWith(op *op.Op, branch, tmpdir, file string) (*os.File,
+	error) {
 	// Create a temporary file
 	tmpfile, err := ioutil.TempFile(tmpdir, strings.Replace(file,
 		"/", "_", -1))
@@ -138,7 +136,6 @@ func makeDiffTempFile(branch, tmpdir, file string) (*os.File, error) {
 	defer tmpfile.Close()
 
 	// cat contents of read file in 'master' to tmp file
-	op := op.StartOp()
 	op.OutputTo(tmpfile)
 	op.Run("git", "show", branch+":"+file)
 	if op.LastError() != nil {
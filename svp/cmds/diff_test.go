@@ -0,0 +1,46 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+)
+
+func TestMakeDiffTempFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svp-test-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "show", "master:src/a.go").Returns("package a\n")
+	fake.Expect("git", "show", "master:src/new.go").Fails(128,
+		"fatal: Path 'src/new.go' does not exist in 'master'\n")
+	fake.Expect("git", "show", "master:src/b.go").Fails(128,
+		"fatal: not a git repository\n")
+
+	f, err := makeDiffTempFile("master", dir, "src/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(f.Name()); string(contents) != "package a\n" {
+		t.Fatalf("expected temp file to contain \"package a\\n\", but got %q",
+			contents)
+	}
+
+	// A file that's new in this branch is compared against an empty file
+	f, err = makeDiffTempFile("master", dir, "src/new.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(f.Name()); len(contents) != 0 {
+		t.Fatalf("expected empty temp file for new file, but got %q", contents)
+	}
+
+	if _, err := makeDiffTempFile("master", dir, "src/b.go"); err == nil {
+		t.Fatal("expected 'git show' failure to be returned, but got nil")
+	}
+}
@@ -1,5 +1,45 @@
 package cmds
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/svp/config"
+)
+
+// ClientInfo is the information about a client that svp caches in
+// ClientDirectory/.svp/cache.json. Fields that are slow to compute are filled
+// in lazily, so any of them may be unset
+type ClientInfo struct {
+	// The number of the client's GitHub pull request (recorded by 'svp mail'),
+	// or 0 if it doesn't have one
+	PullRequest int `json:"pull_request,omitempty"`
+
+	// Can be true or false, or unset if unknown
+	IsPullRequestOpen *bool `json:"is_pull_request_open,omitempty"`
+	// The time at which IsPullRequestOpen was last looked up
+	PullRequestCheckedAt time.Time `json:"pull_request_checked_at,omitempty"`
+
+	// The number of commits that the client's branch is ahead of and behind
+	// origin/master. These are only valid while the client's HEAD and
+	// origin/master are still at the commits in 'Head' and 'Upstream'
+	Ahead    *int   `json:"ahead,omitempty"`
+	Behind   *int   `json:"behind,omitempty"`
+	Head     string `json:"head,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+
+	// The time at which any field in this struct was last updated
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Env contains svp's state, both from the environment and from the cache
 var Env struct {
 	// Config is a struct containing all fields defined in the .svpconfig file
 	// (this is how configured values can be accessed)
@@ -15,19 +55,201 @@ var Env struct {
 	// A map from client name (e.g. "pfs-v2") to information about the client
 	// (e.g. whether there's an open pull request for it)
 	// This is cached
-	Clients map[string]struct {
-		IsPullRequestOpen *bool // Can be true or false, or unset if unknown
-	}
+	Clients map[string]ClientInfo
 
 	// If true, then some cached field has been updated, and the cache file needs
 	// to be re-written
 	IsCacheStale bool
 }
 
-// func init() error {
-// 	getCachedClientInfo()
-// 	getClientInfoSlow()
-// }
+var (
+	// cacheMu guards Env.Clients, Env.IsCacheStale, cacheLoaded and
+	// updatedClients, as svp commands may look up client info from several
+	// goroutines at once
+	cacheMu sync.Mutex
+
+	// cacheLoaded is true once Env.Clients has been read from svp's cache file.
+	// The cache is read the first time it's needed (rather than at startup), so
+	// that commands that don't use it never touch it
+	cacheLoaded bool
+
+	// updatedClients is the set of clients whose cached info has been updated
+	// by this svp process. Only these entries are written back to the cache, so
+	// that svp doesn't clobber updates made by other svp processes
+	updatedClients = make(map[string]struct{})
+)
 
-// func initCache() {
-// }
+func cacheDir() string {
+	return path.Join(config.Config.ClientDirectory, ".svp")
+}
+
+func cachePath() string {
+	return path.Join(cacheDir(), "cache.json")
+}
+
+// lockCache takes a lock on svp's cache (shared if 'exclusive' is false), so
+// that concurrent svp processes don't corrupt it. The lock is held on a
+// separate lock file, as cache.json itself is replaced on every write. Call
+// the returned function to release the lock.
+func lockCache(exclusive bool) (func(), error) {
+	f, err := os.OpenFile(cachePath()+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open cache lock file: %v", err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock cache: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// readCacheFile reads and parses cache.json. The caller must hold a lock from
+// lockCache(). A missing cache file is not an error.
+func readCacheFile() (map[string]ClientInfo, error) {
+	clients := make(map[string]ClientInfo)
+	data, err := ioutil.ReadFile(cachePath())
+	if os.IsNotExist(err) {
+		return clients, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read cache file %s: %v", cachePath(), err)
+	}
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, fmt.Errorf("could not parse cache file %s: %v", cachePath(), err)
+	}
+	return clients, nil
+}
+
+// getCachedClientInfo initializes Env.Clients from svp's cache file. This is
+// fast, but any of the cached fields may be missing or out of date
+func getCachedClientInfo() (map[string]ClientInfo, error) {
+	if _, err := os.Stat(cacheDir()); os.IsNotExist(err) {
+		return make(map[string]ClientInfo), nil // no cache yet
+	}
+	unlock, err := lockCache(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return readCacheFile()
+}
+
+// loadCache reads svp's cache file into Env.Clients, if it hasn't been read
+// yet. An unreadable cache is logged and ignored. The caller must hold cacheMu.
+func loadCache() {
+	if cacheLoaded {
+		return
+	}
+	clients, err := getCachedClientInfo()
+	if err != nil {
+		log.Printf("error reading svp cache (ignoring it): %v", err)
+		clients = make(map[string]ClientInfo)
+	}
+	Env.Clients = clients
+	cacheLoaded = true
+}
+
+// cachedClient returns the cached info for the client 'name' (which may be
+// empty)
+func cachedClient(name string) ClientInfo {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	loadCache()
+	return Env.Clients[name]
+}
+
+// updateCachedClient applies 'f' to the cached info for the client 'name', and
+// marks the cache as stale so that it's written back by WriteCache()
+func updateCachedClient(name string, f func(*ClientInfo)) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	loadCache()
+	info := Env.Clients[name]
+	f(&info)
+	info.UpdatedAt = time.Now()
+	Env.Clients[name] = info
+	updatedClients[name] = struct{}{}
+	Env.IsCacheStale = true
+}
+
+// getClientInfoSlow returns the number of commits that the client 'name' is
+// ahead of and behind origin/master, given the commit IDs of the client's HEAD
+// and origin/master. The result is cached until either commit changes, since
+// 'git rev-list' can be slow when the branches have diverged a lot
+func getClientInfoSlow(name, repo, head, upstream string) (ahead, behind int,
+	err error) {
+	info := cachedClient(name)
+	if info.Ahead != nil && info.Behind != nil && info.Head == head &&
+		info.Upstream == upstream {
+		return *info.Ahead, *info.Behind, nil
+	}
+	ahead, behind, err = aheadBehind(repo, head, upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	updateCachedClient(name, func(info *ClientInfo) {
+		info.Ahead, info.Behind = &ahead, &behind
+		info.Head, info.Upstream = head, upstream
+	})
+	return ahead, behind, nil
+}
+
+// WriteCache writes Env.Clients back to svp's cache file, if any cached field
+// has been updated. Entries that this process hasn't updated are taken from
+// the cache file on disk, so concurrent svp processes don't lose each other's
+// updates. The file is replaced atomically, so readers never see a partially
+// written cache. svp calls this before exiting, whether or not the command
+// succeeded.
+func WriteCache() error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if !Env.IsCacheStale || DryRun {
+		return nil
+	}
+	if err := os.MkdirAll(cacheDir(), 0755); err != nil {
+		return fmt.Errorf("could not create cache directory: %v", err)
+	}
+	unlock, err := lockCache(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Merge this process's updates into the latest cache on disk
+	clients, err := readCacheFile()
+	if err != nil {
+		log.Printf("discarding unreadable cache: %v", err)
+		clients = make(map[string]ClientInfo)
+	}
+	for name := range updatedClients {
+		disk, ok := clients[name]
+		if ok && disk.UpdatedAt.After(Env.Clients[name].UpdatedAt) {
+			continue // another svp process wrote newer info
+		}
+		clients[name] = Env.Clients[name]
+	}
+	data, err := json.MarshalIndent(clients, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not serialize cache: %v", err)
+	}
+	tmpName, err := writeToTmpfile(cacheDir(), "cache.json.tmp-", data)
+	if err != nil {
+		if tmpName != "" {
+			os.Remove(tmpName)
+		}
+		return err
+	}
+	if err := os.Rename(tmpName, cachePath()); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("could not replace cache file: %v", err)
+	}
+	Env.IsCacheStale = false
+	updatedClients = make(map[string]struct{})
+	return nil
+}
@@ -0,0 +1,182 @@
+package cmds
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCache replaces svp's in-memory cache with 'clients' for the rest of the
+// test. If 'clients' is nil, the cache is read from the cache file (in the
+// current clients directory) the next time it's used.
+func useCache(t *testing.T, clients map[string]ClientInfo) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	prevClients, prevLoaded := Env.Clients, cacheLoaded
+	Env.Clients, cacheLoaded = clients, clients != nil
+	Env.IsCacheStale, updatedClients = false, make(map[string]struct{})
+	t.Cleanup(func() {
+		cacheMu.Lock()
+		defer cacheMu.Unlock()
+		Env.Clients, cacheLoaded = prevClients, prevLoaded
+		Env.IsCacheStale, updatedClients = false, make(map[string]struct{})
+	})
+}
+
+// writeCacheFile writes 'clients' to the cache file in 'dir'
+func writeCacheFile(t *testing.T, dir string, clients map[string]ClientInfo) {
+	mkdirs(t, dir, ".svp")
+	data, err := json.Marshal(clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, ".svp/cache.json"), data,
+		0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCache reads the cache file in 'dir'
+func readCache(t *testing.T, dir string) map[string]ClientInfo {
+	data, err := ioutil.ReadFile(path.Join(dir, ".svp/cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clients map[string]ClientInfo
+	if err := json.Unmarshal(data, &clients); err != nil {
+		t.Fatal(err)
+	}
+	return clients
+}
+
+func TestCacheLoadedLazily(t *testing.T) {
+	dir := clientDir(t)
+	useCache(t, nil)
+	writeCacheFile(t, dir, map[string]ClientInfo{"foo": {PullRequest: 3}})
+
+	// The cache file is read on first use, not before
+	if cacheLoaded {
+		t.Fatal("expected the cache not to be loaded before it's used")
+	}
+	if got := cachedClient("foo").PullRequest; got != 3 {
+		t.Fatalf("expected cached PR 3, but got %d", got)
+	}
+
+	// A missing or unreadable cache is treated as empty
+	for _, contents := range []string{"", "not json"} {
+		useCache(t, nil)
+		os.Remove(path.Join(dir, ".svp/cache.json"))
+		if contents != "" {
+			ioutil.WriteFile(path.Join(dir, ".svp/cache.json"), []byte(contents),
+				0644)
+		}
+		if got := cachedClient("foo").PullRequest; got != 0 {
+			t.Fatalf("with cache %q: expected no cached PR, but got %d",
+				contents, got)
+		}
+	}
+}
+
+func TestWriteCacheMerge(t *testing.T) {
+	dir := clientDir(t)
+	useCache(t, nil)
+	start := time.Now()
+	writeCacheFile(t, dir, map[string]ClientInfo{
+		"a": {PullRequest: 1, UpdatedAt: start},
+		"b": {PullRequest: 2, UpdatedAt: start},
+	})
+	updateCachedClient("a", func(info *ClientInfo) { info.PullRequest = 10 })
+	updateCachedClient("b", func(info *ClientInfo) { info.PullRequest = 20 })
+
+	// Meanwhile, another svp process updates "b" (after this one did) and adds
+	// "c"
+	writeCacheFile(t, dir, map[string]ClientInfo{
+		"a": {PullRequest: 1, UpdatedAt: start},
+		"b": {PullRequest: 200, UpdatedAt: time.Now().Add(time.Minute)},
+		"c": {PullRequest: 300, UpdatedAt: start},
+	})
+	if err := WriteCache(); err != nil {
+		t.Fatal(err)
+	}
+	clients := readCache(t, dir)
+	for name, want := range map[string]int{"a": 10, "b": 200, "c": 300} {
+		if got := clients[name].PullRequest; got != want {
+			t.Errorf("expected PR %d for %s, but got %d", want, name, got)
+		}
+	}
+	if Env.IsCacheStale {
+		t.Error("expected the cache not to be stale after WriteCache")
+	}
+}
+
+func TestWriteCacheLocks(t *testing.T) {
+	dir := clientDir(t)
+	useCache(t, nil)
+	writeCacheFile(t, dir, map[string]ClientInfo{})
+	updateCachedClient("a", func(info *ClientInfo) { info.PullRequest = 1 })
+
+	// WriteCache must wait for another process's lock on the cache
+	unlock, err := lockCache(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- WriteCache() }()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("expected WriteCache to wait for the lock, but it returned %v",
+			err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := readCache(t, dir)["a"].PullRequest; got != 1 {
+		t.Fatalf("expected cached PR 1, but got %d", got)
+	}
+}
+
+func TestWriteCacheAtomic(t *testing.T) {
+	dir := clientDir(t)
+	useCache(t, nil)
+	writeCacheFile(t, dir, map[string]ClientInfo{"a": {PullRequest: 1}})
+
+	// A reader that has the old cache file open keeps seeing the old cache, as
+	// the file is replaced rather than rewritten
+	old, err := os.Open(path.Join(dir, ".svp/cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	updateCachedClient("a", func(info *ClientInfo) { info.PullRequest = 2 })
+	if err := WriteCache(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"pull_request":1`) {
+		t.Fatalf("expected the old cache file to be unchanged, but got %s", data)
+	}
+	if got := readCache(t, dir)["a"].PullRequest; got != 2 {
+		t.Fatalf("expected cached PR 2, but got %d", got)
+	}
+
+	// No temp files are left behind
+	infos, err := ioutil.ReadDir(path.Join(dir, ".svp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), "cache.json.tmp-") {
+			t.Errorf("unexpected temp file %s", info.Name())
+		}
+	}
+}
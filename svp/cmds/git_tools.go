@@ -8,14 +8,50 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/msteffen/pachyderm-tools/op"
 	"github.com/msteffen/pachyderm-tools/svp/config"
 	"github.com/msteffen/pachyderm-tools/svp/git"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-var branch string // branch to diff against for 'diff' and 'changed' ("master" by default)
+// defaultBranch is the branch that 'diff' and 'changed' compare against if
+// neither --branch nor "diff": {"branch": ...} in .svpconfig is set
+const defaultBranch = "origin/master"
+
+var branch string // branch to diff against for 'diff' and 'changed' (see baseBranch())
+
+// flagOrConfig returns the value of a flag, unless it wasn't set (i.e. it's
+// 'magicStr'), in which case it returns the configured value, or 'fallback'
+// if that's also unset
+func flagOrConfig(flag, configured, fallback string) string {
+	switch {
+	case flag != magicStr:
+		return flag
+	case configured != "":
+		return configured
+	default:
+		return fallback
+	}
+}
+
+// unsetFlagVarP registers a string flag whose default value is 'magicStr' (so
+// that flagOrConfig() can tell whether it was set), without printing
+// 'magicStr' as its default in svp's help text
+func unsetFlagVarP(flags *pflag.FlagSet, p *string, name, shorthand,
+	usage string) {
+	flags.StringVarP(p, name, shorthand, magicStr, usage)
+	flags.Lookup(name).DefValue = ""
+}
+
+// baseBranch returns the branch to compare against, from the --branch flag or
+// .svpconfig
+func baseBranch() string {
+	return flagOrConfig(branch, config.Config.Diff.Branch, defaultBranch)
+}
 
 func checkGitRepoAndCdToRoot() error {
 	if git.Root == "" {
@@ -53,9 +89,27 @@ func gitUnboundedCommand(f Command) func(*cobra.Command, []string) {
 	})
 }
 
+// skipRegexp compiles the regex used to skip uninteresting files in
+// 'svp diff', 'svp changed' and 'svp resume'. 'skip' is the value of the command's --skip
+// flag, which overrides the configured regex unless it's 'magicStr'. If no
+// files should be skipped, the result is nil.
+func skipRegexp(skip string) (*regexp.Regexp, error) {
+	skip2 := flagOrConfig(skip, config.Config.Diff.Skip, "")
+	if skip2 == "" {
+		return nil, nil // don't filter (the empty regex would match every file)
+	}
+	skipRe, err := regexp.Compile(skip2)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile regex \"%s\" for skipping "+
+			"files: %s", skip2, err)
+	}
+	return skipRe, nil
+}
+
 // changedFilesCommand returns a Cobra command that prints the output of
 // modifiedFiles()
 func changedFilesCommand() *cobra.Command {
+	var skip string // regex--instruct 'svp changed' to skip files that match
 	changed := &cobra.Command{
 		Use:   "changed",
 		Short: "List the files that have changed between this branch and master",
@@ -63,22 +117,40 @@ func changedFilesCommand() *cobra.Command {
 			if git.Root == "" {
 				return fmt.Errorf("changed must be run from inside a git repo")
 			}
+			branch := baseBranch()
+			skipRe, err := skipRegexp(skip)
+			if err != nil {
+				return err
+			}
 			// Sanitize 'branch' and don't run diff if 'branch' doesn't make sense
-			files, err := modifiedFiles(git.CurBranch, branch)
+			files0, err := modifiedFiles(git.CurBranch, branch)
 			if err != nil {
 				return err
 			}
+			var files []string
+			for _, file := range files0 {
+				if skipRe == nil || !skipRe.MatchString(file) {
+					files = append(files, file)
+				}
+			}
 			fmt.Println(strings.Join(files, "\n"))
 			return nil
 		}),
 	}
 
-	// 'branch' is declared in diff.go
-	changed.PersistentFlags().StringVarP(&branch, "branch", "b", "origin/master",
-		"Show changed files relative to this branch")
+	unsetFlagVarP(changed.PersistentFlags(), &branch, "branch", "b",
+		"Show changed files relative to this branch (default: \"diff\": "+
+			"{\"branch\": ...} in .svpconfig, or \""+defaultBranch+"\")")
+	unsetFlagVarP(changed.PersistentFlags(), &skip, "skip", "",
+		"A regex that is used to skip files encountered by 'svp changed' (e.g. "+
+			"vendored files or .gitignore)")
 	return changed
 }
 
+// diffParallelism is the maximum number of 'git show' commands that 'svp
+// diff' runs at once
+const diffParallelism = 8
+
 // diffCommand returns a cobra command that applies the diff tool to a given
 // file, or to all of the files changed in this workspace
 func diffCommand() *cobra.Command {
@@ -88,15 +160,16 @@ func diffCommand() *cobra.Command {
 		Use:   "diff <filename>",
 		Short: "Diff files against some other branch of the pachyderm repo",
 		Run: gitUnboundedCommand(func(args []string) error {
-			// Compile regex for skipping uninteresting files
-			skip2 := config.Config.Diff.Skip
-			if skip != magicStr {
-				skip2 = skip
+			branch := baseBranch()
+			tool := flagOrConfig(tool, config.Config.Diff.Tool, config.Config.DiffTool)
+			if tool == "" {
+				tool = "meld"
 			}
-			skipRe, err := regexp.Compile(config.Config.Diff.Skip)
+
+			// Compile regex for skipping uninteresting files
+			skipRe, err := skipRegexp(skip)
 			if err != nil {
-				return fmt.Errorf("could not compile regex \"%s\" for skipping files: %s",
-					skip2, err)
+				return err
 			}
 
 			// Get either 1) list of files that have changed between 'master' and
@@ -106,11 +179,11 @@ func diffCommand() *cobra.Command {
 				files0, err := modifiedFiles(git.CurBranch, branch)
 				if err != nil {
 					return fmt.Errorf("could not get list of changed files "+
-						"(to diff):\n%s", err)
+						"(to diff):\n%w", err)
 				}
 				// Filter out uninteresting files
 				for _, file := range files0 {
-					if !skipRe.MatchString(file) {
+					if skipRe == nil || !skipRe.MatchString(file) {
 						files = append(files, file)
 					}
 				}
@@ -138,13 +211,19 @@ func diffCommand() *cobra.Command {
 			defer os.RemoveAll(tmpdir)
 
 			// Populate the temporary directory with tmp files containing file
-			// contents from 'branch'
+			// contents from 'branch' (running 'git show' for several files at once)
 			tmpfiles := make([]*os.File, len(files))
+			g := op.NewGroup(ctx, diffParallelism).StartOpWith(queryOp).
+				CancelOnFailure()
 			for i, file := range files {
-				tmpfiles[i], err = makeDiffTempFile(branch, tmpdir, file)
-				if err != nil {
+				i, file := i, file
+				g.Go(file, func(o *op.Op) (err error) {
+					tmpfiles[i], err = makeDiffTempFileWith(o, branch, tmpdir, file)
 					return err
-				}
+				})
+			}
+			if err := g.Wait(); err != nil {
+				return err
 			}
 
 			// Run diff tool selected by user
@@ -160,21 +239,94 @@ func diffCommand() *cobra.Command {
 		}),
 	}
 
-	diff.PersistentFlags().StringVarP(&branch, "branch", "b", "origin/master",
-		"The branch to diff against")
-	diff.PersistentFlags().StringVarP(&tool, "tool", "t", "meld",
-		"The branch to diff against")
-	diff.PersistentFlags().StringVar(&skip, "skip", magicStr,
+	unsetFlagVarP(diff.PersistentFlags(), &branch, "branch", "b",
+		"The branch to diff against (default: \"diff\": {\"branch\": ...} in "+
+			".svpconfig, or \""+defaultBranch+"\")")
+	unsetFlagVarP(diff.PersistentFlags(), &tool, "tool", "t",
+		"The tool to view the diff with: \"meld\" or \"vim\" (default: \"diff\": "+
+			"{\"tool\": ...} in .svpconfig, or \"meld\")")
+	unsetFlagVarP(diff.PersistentFlags(), &skip, "skip", "",
 		"A regex that is used to skip files encountered by 'svp diff' (e.g. "+
 			"vendored files or .gitignore)")
 	return diff
 }
 
+// resumeCommand returns a cobra command that opens all of the files that have
+// changed in this branch in $EDITOR, most recently modified first
+func resumeCommand() *cobra.Command {
+	var skip string // regex--instruct 'svp resume' to skip files that match
+	resume := &cobra.Command{
+		Use:   "resume",
+		Short: "Open all files changed in this branch in $EDITOR",
+		Run: gitBoundedCommand(0, 0, func(args []string) error {
+			branch := baseBranch()
+			skipRe, err := skipRegexp(skip)
+			if err != nil {
+				return err
+			}
+			files0, err := modifiedFiles(git.CurBranch, branch)
+			if err != nil {
+				return fmt.Errorf("could not get list of changed files "+
+					"(to open):\n%w", err)
+			}
+
+			// Filter out uninteresting and deleted files, and sort the rest so that
+			// the most recently modified file is opened first
+			var files []string
+			modTimes := make(map[string]time.Time)
+			for _, file := range files0 {
+				if skipRe != nil && skipRe.MatchString(file) {
+					continue
+				}
+				fullFilename := path.Join(git.Root, file)
+				info, err := os.Stat(fullFilename)
+				if err != nil {
+					continue // file was deleted in this branch
+				}
+				files = append(files, fullFilename)
+				modTimes[fullFilename] = info.ModTime()
+			}
+			if len(files) == 0 {
+				return fmt.Errorf("no differing files found between \"%s\" and \"%s\"",
+					git.CurBranch, branch)
+			}
+			sort.Slice(files, func(i, j int) bool {
+				return modTimes[files[i]].After(modTimes[files[j]])
+			})
+
+			// $EDITOR may include arguments (e.g. "emacs -nw")
+			editor := strings.Fields(os.Getenv("EDITOR"))
+			if len(editor) == 0 {
+				editor = []string{"vim"}
+			}
+			op := startOp().Interactive()
+			if err := op.Run(append(editor, files...)...); err != nil {
+				return fmt.Errorf("could not run editor %s:\n%w", editor[0],
+					op.DetailedError())
+			}
+			return nil
+		}),
+	}
+
+	unsetFlagVarP(resume.PersistentFlags(), &branch, "branch", "b",
+		"Open files changed relative to this branch (default: \"diff\": "+
+			"{\"branch\": ...} in .svpconfig, or \""+defaultBranch+"\")")
+	unsetFlagVarP(resume.PersistentFlags(), &skip, "skip", "",
+		"A regex that is used to skip files encountered by 'svp resume' (e.g. "+
+			"vendored files or .gitignore)")
+	return resume
+}
+
 // GitHelperCommands returns Cobra commands that print the outputs of
 // CurBranch() and GitRoot()
 func GitHelperCommands() []*cobra.Command {
 	return []*cobra.Command{
 		changedFilesCommand(),
 		diffCommand(),
+		syncCommand(),
+		resumeCommand(),
+		submitCommand(),
+		mailCommand(),
+		testCommand(),
 	}
 }
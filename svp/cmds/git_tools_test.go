@@ -0,0 +1,106 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/config"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+)
+
+func TestFlagOrConfig(t *testing.T) {
+	for _, c := range []struct {
+		name, flag, configured, want string
+	}{
+		{"flag set", "flag", "configured", "flag"},
+		{"flag set to empty", "", "configured", ""},
+		{"config set", magicStr, "configured", "configured"},
+		{"neither set", magicStr, "", "fallback"},
+	} {
+		if got := flagOrConfig(c.flag, c.configured, "fallback"); got != c.want {
+			t.Errorf("%s: expected %q, but got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestSkipRegexp(t *testing.T) {
+	defer func(prev string) { config.Config.Diff.Skip = prev }(config.Config.Diff.Skip)
+	for _, c := range []struct {
+		name, flag, configured string
+		want                   string // the compiled regex, or "" for nil
+	}{
+		{"flag set", "^vendor/", "_test\\.go$", "^vendor/"},
+		{"flag set to empty", "", "_test\\.go$", ""},
+		{"config set", magicStr, "_test\\.go$", "_test\\.go$"},
+		{"neither set", magicStr, "", ""},
+	} {
+		config.Config.Diff.Skip = c.configured
+		re, err := skipRegexp(c.flag)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		got := ""
+		if re != nil {
+			got = re.String()
+		}
+		if got != c.want {
+			t.Errorf("%s: expected regex %q, but got %q", c.name, c.want, got)
+		}
+	}
+
+	config.Config.Diff.Skip = "("
+	if _, err := skipRegexp(magicStr); err == nil {
+		t.Error("expected an error for an invalid configured regex")
+	}
+}
+
+func TestResumeCommand(t *testing.T) {
+	root, err := ioutil.TempDir("", "svp-test-repo-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd) // the command cds to the root of the repo
+	defer func(root, curBranch, flag string) {
+		git.Root, git.CurBranch, branch = root, curBranch, flag
+	}(git.Root, git.CurBranch, branch)
+	git.Root, git.CurBranch = root, "feature"
+	t.Setenv("EDITOR", "emacs -nw")
+
+	// b.go was modified more recently than a.go, so it's opened first
+	mkdirs(t, root, "vendor")
+	for i, file := range []string{"a.go", "b.go", "vendor/v.go"} {
+		p := path.Join(root, file)
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleted.go doesn't exist, and vendor/v.go is skipped
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "diff", "--name-only", "feature", "master").
+		Returns("a.go\nvendor/v.go\ndeleted.go\n")
+	fake.Expect("git", "status", "--porcelain").Returns(" M b.go\n")
+	fake.Expect("emacs", "-nw", path.Join(root, "b.go"), path.Join(root, "a.go"))
+	cmd := resumeCommand()
+	cmd.SetArgs([]string{"--branch", "master", "--skip", "^vendor/"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
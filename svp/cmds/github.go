@@ -0,0 +1,165 @@
+package cmds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/svp/config"
+)
+
+// pullRequestTTL is how long a client's cached pull request status is trusted
+// before it's looked up again
+const pullRequestTTL = 10 * time.Minute
+
+var (
+	// githubRemote extracts "owner/name" from the URL of a GitHub remote, e.g.
+	// git@github.com:pachyderm/pachyderm.git or
+	// https://github.com/pachyderm/pachyderm
+	/* const */ githubRemote = regexp.MustCompile(
+		`github\.com[:/]([[:word:].-]+/[[:word:].-]+?)(\.git)?/?$`)
+
+	// githubClient is used for all requests to GitHub's API
+	githubClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// pullRequest contains the fields of a GitHub pull request that svp uses
+type pullRequest struct {
+	Number  int    `json:"number"`
+	State   string `json:"state"` // "open" or "closed"
+	HTMLURL string `json:"html_url"`
+}
+
+// githubRepo returns the GitHub repo ("owner/name") that pull requests for
+// the git repo at 'dir' should be opened against (if 'dir' is empty, the
+// current git repo is used)
+func githubRepo(dir string) (string, error) {
+	if config.Config.GitHub.Repo != "" {
+		return config.Config.GitHub.Repo, nil
+	}
+	args := []string{"git", "remote", "get-url", "origin"}
+	if dir != "" {
+		args = []string{"git", "-C", dir, "remote", "get-url", "origin"}
+	}
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run(args...)
+	if err := op.DetailedError(); err != nil {
+		return "", err
+	}
+	url := strings.TrimSpace(op.Output())
+	m := githubRemote.FindStringSubmatch(url)
+	if m == nil {
+		return "", fmt.Errorf("could not infer GitHub repo from origin URL %q; set "+
+			"\"github\": {\"repo\": \"owner/name\"} in .svpconfig", url)
+	}
+	return m[1], nil
+}
+
+// githubRequest sends a request to GitHub's API, with 'in' (if non-nil) as the
+// JSON request body, and parses the JSON response into 'out' (if non-nil)
+func githubRequest(method, apiPath string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return fmt.Errorf("could not serialize GitHub request: %v", err)
+		}
+	}
+	url := strings.TrimSuffix(config.Config.GitHub.APIURL, "/") + apiPath
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return fmt.Errorf("could not create GitHub request: %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	token := config.Config.GitHub.Token
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	resp, err := githubClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send GitHub request (%s %s): %v", method, url,
+			err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read GitHub response (%s %s): %v", method,
+			url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GitHub request failed (%s %s): %s\n%s", method, url,
+			resp.Status, bytes.TrimSpace(respBody))
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("could not parse GitHub response (%s %s): %v", method,
+				url, err)
+		}
+	}
+	return nil
+}
+
+// createPullRequest opens a pull request in the GitHub repo 'repo' to merge
+// 'head' into 'base'
+func createPullRequest(repo, head, base, title, body string) (*pullRequest,
+	error) {
+	var pr pullRequest
+	if err := githubRequest("POST", "/repos/"+repo+"/pulls", map[string]string{
+		"title": title,
+		"head":  head,
+		"base":  base,
+		"body":  body,
+	}, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// getPullRequest looks up pull request 'number' in the GitHub repo 'repo'
+func getPullRequest(repo string, number int) (*pullRequest, error) {
+	var pr pullRequest
+	if err := githubRequest("GET", fmt.Sprintf("/repos/%s/pulls/%d", repo,
+		number), nil, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// pullRequestOpen returns whether the pull request recorded for the client
+// 'name' (whose git repo is at 'repo') is open, looking it up on GitHub if
+// the cached status is missing or older than pullRequestTTL. It returns nil if
+// the client has no recorded pull request or its status can't be looked up.
+func pullRequestOpen(name, repo string) *bool {
+	info := cachedClient(name)
+	if info.PullRequest == 0 {
+		return nil
+	}
+	if info.IsPullRequestOpen != nil &&
+		time.Since(info.PullRequestCheckedAt) < pullRequestTTL {
+		return info.IsPullRequestOpen
+	}
+	ghRepo, err := githubRepo(repo)
+	if err != nil {
+		return info.IsPullRequestOpen
+	}
+	pr, err := getPullRequest(ghRepo, info.PullRequest)
+	if err != nil {
+		return info.IsPullRequestOpen
+	}
+	open := pr.State == "open"
+	updateCachedClient(name, func(info *ClientInfo) {
+		info.IsPullRequestOpen = &open
+		info.PullRequestCheckedAt = time.Now()
+	})
+	return &open
+}
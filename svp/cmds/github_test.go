@@ -0,0 +1,76 @@
+package cmds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/svp/config"
+)
+
+// withGitHub points svp's GitHub client at a local stand-in for GitHub's API
+// for the duration of a test
+func withGitHub(t *testing.T, h http.HandlerFunc) {
+	t.Helper()
+	s := httptest.NewServer(h)
+	oldURL, oldToken := config.Config.GitHub.APIURL, config.Config.GitHub.Token
+	config.Config.GitHub.APIURL = s.URL
+	config.Config.GitHub.Token = "test-token"
+	t.Cleanup(func() {
+		s.Close()
+		config.Config.GitHub.APIURL, config.Config.GitHub.Token = oldURL, oldToken
+	})
+}
+
+func TestCreatePullRequest(t *testing.T) {
+	withGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/repos/owner/repo/pulls" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "token test-token" {
+			t.Errorf("unexpected Authorization header: %q", auth)
+		}
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("could not parse request: %v", err)
+		}
+		if req["head"] != "feature" || req["base"] != "master" ||
+			req["title"] != "Add feature" {
+			t.Errorf("unexpected request body: %v", req)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 7, "state": "open", "html_url": "http://pr/7"}`))
+	})
+	pr, err := createPullRequest("owner/repo", "feature", "master",
+		"Add feature", "body")
+	if err != nil {
+		t.Fatalf("createPullRequest: %v", err)
+	}
+	if pr.Number != 7 || pr.State != "open" || pr.HTMLURL != "http://pr/7" {
+		t.Fatalf("unexpected pull request: %+v", pr)
+	}
+}
+
+func TestGetPullRequestError(t *testing.T) {
+	withGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	})
+	if _, err := getPullRequest("owner/repo", 7); err == nil {
+		t.Fatal("expected an error for a missing pull request, but got nil")
+	}
+}
+
+func TestGitHubRemote(t *testing.T) {
+	for url, want := range map[string]string{
+		"git@github.com:pachyderm/pachyderm.git":  "pachyderm/pachyderm",
+		"https://github.com/pachyderm/pachyderm":  "pachyderm/pachyderm",
+		"https://github.com/msteffen/svp.tools/":  "msteffen/svp.tools",
+		"ssh://git@github.com/pachyderm/docs.git": "pachyderm/docs",
+	} {
+		m := githubRemote.FindStringSubmatch(url)
+		if m == nil || m[1] != want {
+			t.Errorf("expected %q to match %q, but got %v", url, want, m)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+
+	"github.com/spf13/cobra"
+)
+
+// goPackage contains the fields of 'go list -json' output that 'svp test'
+// uses to build the reverse import graph
+type goPackage struct {
+	ImportPath   string
+	Dir          string
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+// goOp sets up 'o' to run 'go' commands in the git repo at 'root', and
+// returns it. If 'root' is inside a GOPATH-style client (i.e.
+// <client>/src/github.com/...), GOPATH is set to the client, so that svp
+// works even if the shell's GOPATH points at a different client
+func goOp(o *op.Op, root string) *op.Op {
+	o.Dir(root)
+	if i := strings.LastIndex(root, "/src/"); i >= 0 {
+		o.Setenv("GOPATH", root[:i])
+	}
+	return o
+}
+
+// listGoPackages returns all go packages in the git repo at 'root'
+func listGoPackages(root string) ([]goPackage, error) {
+	op := goOp(queryOp(), root)
+	op.CollectStdOut()
+	op.Run("go", "list", "-e", "-json", "./...")
+	if err := op.DetailedError(); err != nil {
+		return nil, fmt.Errorf("could not list go packages:\n%w", err)
+	}
+	var pkgs []goPackage
+	for d := json.NewDecoder(strings.NewReader(op.Output())); ; {
+		var pkg goPackage
+		if err := d.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse output of 'go list': %v", err)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// affectedPackages returns the import paths of all packages in 'pkgs' that
+// contain one of 'files' (paths relative to 'root'), or that depend on such a
+// package (directly or transitively, including via tests). Files outside of
+// any package (e.g. in testdata/) count towards the nearest enclosing
+// package.
+func affectedPackages(root string, pkgs []goPackage, files []string) []string {
+	byDir := make(map[string]string) // package dir -> import path
+	importers := make(map[string][]string)
+	for _, pkg := range pkgs {
+		byDir[pkg.Dir] = pkg.ImportPath
+		for _, imports := range [][]string{pkg.Imports, pkg.TestImports,
+			pkg.XTestImports} {
+			for _, i := range imports {
+				importers[i] = append(importers[i], pkg.ImportPath)
+			}
+		}
+	}
+
+	// Find packages containing 'files'
+	var queue []string
+	affected := make(map[string]struct{})
+	for _, file := range files {
+		dir := path.Dir(path.Join(root, file))
+		for {
+			if pkg, ok := byDir[dir]; ok {
+				if _, ok := affected[pkg]; !ok {
+					affected[pkg] = struct{}{}
+					queue = append(queue, pkg)
+				}
+				break
+			}
+			if dir == root || dir == "/" {
+				break // 'file' isn't in any package
+			}
+			dir = path.Dir(dir)
+		}
+	}
+
+	// Walk the reverse import graph
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, importer := range importers[pkg] {
+			if _, ok := affected[importer]; !ok {
+				affected[importer] = struct{}{}
+				queue = append(queue, importer)
+			}
+		}
+	}
+	result := make([]string, 0, len(affected))
+	for pkg := range affected {
+		result = append(result, pkg)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// testCommand returns a cobra command that runs the tests of every go package
+// affected by the changes in this branch
+func testCommand() *cobra.Command {
+	var run string
+	var race bool
+	test := &cobra.Command{
+		Use:   "test",
+		Short: "Run the tests of all go packages affected by this branch",
+		Long: "Find the go packages containing files changed in this branch " +
+			"(relative to --branch), and all packages that import them, " +
+			"and run 'go test' on exactly those packages (or, with --dry-run, " +
+			"print them).",
+		Run: gitBoundedCommand(0, 0, func(args []string) error {
+			files, err := modifiedFiles(git.CurBranch, baseBranch())
+			if err != nil {
+				return fmt.Errorf("could not get list of changed files "+
+					"(to test):\n%w", err)
+			}
+			pkgs, err := listGoPackages(git.Root)
+			if err != nil {
+				return err
+			}
+			affected := affectedPackages(git.Root, pkgs, files)
+			if len(affected) == 0 {
+				fmt.Println("no go packages affected by this branch")
+				return nil
+			}
+			if DryRun {
+				// With --dry-run, 'svp test' prints the affected packages
+				fmt.Println(strings.Join(affected, "\n"))
+				return nil
+			}
+
+			testArgs := []string{"test"}
+			if race {
+				testArgs = append(testArgs, "-race")
+			}
+			if run != "" {
+				testArgs = append(testArgs, "-run", run)
+			}
+			op := goOp(startOp(), git.Root)
+			op.OutputTo(os.Stdout)
+			op.TeeStdErr(os.Stderr)
+			if err := op.Run(append([]string{"go"}, append(testArgs,
+				affected...)...)...); err != nil {
+				return fmt.Errorf("tests failed:\n%w", op.DetailedError())
+			}
+			return nil
+		}),
+	}
+	unsetFlagVarP(test.PersistentFlags(), &branch, "branch", "b",
+		"Test packages affected by changes relative to this branch (default: "+
+			"\"diff\": {\"branch\": ...} in .svpconfig, or \""+defaultBranch+"\")")
+	test.Flags().StringVar(&run, "run", "", "Only run tests matching this "+
+		"regex (passed to 'go test -run')")
+	test.Flags().BoolVar(&race, "race", false, "Run tests with the race "+
+		"detector enabled")
+	return test
+}
@@ -0,0 +1,87 @@
+package cmds
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+)
+
+func TestAffectedPackages(t *testing.T) {
+	pkgs := []goPackage{
+		{ImportPath: "x/a", Dir: "/r/a"},
+		{ImportPath: "x/b", Dir: "/r/b", Imports: []string{"x/a", "fmt"}},
+		{ImportPath: "x/c", Dir: "/r/c", TestImports: []string{"x/b"}},
+		{ImportPath: "x/d", Dir: "/r/d", Imports: []string{"fmt"}},
+		{ImportPath: "x/e", Dir: "/r/e", XTestImports: []string{"x/d"}},
+	}
+	for _, tc := range []struct {
+		files []string
+		want  []string
+	}{
+		{[]string{"a/a.go"}, []string{"x/a", "x/b", "x/c"}},
+		{[]string{"c/c_test.go"}, []string{"x/c"}},
+		{[]string{"d/testdata/in.txt"}, []string{"x/d", "x/e"}},
+		{[]string{"README.md", "b/b.go"}, []string{"x/b", "x/c"}},
+		{[]string{"README.md"}, []string{}},
+	} {
+		got := affectedPackages("/r", pkgs, tc.files)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("affectedPackages(%v): expected %v, but got %v", tc.files,
+				tc.want, got)
+		}
+	}
+}
+
+func TestTestCommandDryRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "svp-test-repo-")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd) // the command cds to the root of the repo
+	defer func(dryRun bool, root, curBranch, flag string) {
+		DryRun, git.Root, git.CurBranch, branch = dryRun, root, curBranch, flag
+	}(DryRun, git.Root, git.CurBranch, branch)
+	DryRun, git.Root, git.CurBranch = true, root, "feature"
+
+	// Even with --dry-run, 'svp test' must query git and 'go list' to find
+	// the affected packages
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "diff", "--name-only", "feature", "master").
+		Returns("b/b.go\n")
+	fake.Expect("git", "status", "--porcelain")
+	fake.Expect("go", "list", "-e", "-json", "./...").InDir(root).Returns(
+		fmt.Sprintf(`{"ImportPath": "x/a", "Dir": "%[1]s/a"}
+			{"ImportPath": "x/b", "Dir": "%[1]s/b", "Imports": ["x/a"]}
+			{"ImportPath": "x/c", "Dir": "%[1]s/c", "Imports": ["x/b"]}`, root))
+
+	stdout, err := ioutil.TempFile("", "svp-test-stdout-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer func(prev *os.File) { os.Stdout = prev }(os.Stdout)
+	os.Stdout = stdout
+	cmd := testCommand()
+	cmd.SetArgs([]string{"--branch", "master"})
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(output), "x/b\nx/c\n"; got != want {
+		t.Fatalf("expected 'svp test --dry-run' to print %q, but got %q", want,
+			got)
+	}
+}
@@ -0,0 +1,142 @@
+package cmds
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/svp/git"
+
+	"github.com/spf13/cobra"
+)
+
+// pullRequestText generates the title and body of a pull request for the
+// commits in 'branch' that aren't in 'base'. If there's one commit, its
+// message is used directly. Otherwise the title is the first commit's subject,
+// and the body lists all of the commits. Either way, the body ends with the
+// list of changed files.
+func pullRequestText(branch, base string) (title, body string, err error) {
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run("git", "log", "--reverse", "--format=%s", base+".."+branch)
+	subjects := strings.Split(strings.TrimSpace(op.Output()), "\n")
+	op.Run("git", "log", "-1", "--format=%b", branch)
+	lastBody := strings.TrimSpace(op.Output())
+	if err := op.DetailedError(); err != nil {
+		return "", "", err
+	}
+	if len(subjects) == 0 || subjects[0] == "" {
+		return "", "", fmt.Errorf("%s has no commits that aren't in %s", branch,
+			base)
+	}
+	files, err := committedFiles(base, branch)
+	if err != nil {
+		return "", "", err
+	}
+	sortedFiles := make([]string, 0, len(files))
+	for f := range files {
+		sortedFiles = append(sortedFiles, f)
+	}
+	sort.Strings(sortedFiles)
+
+	var buf bytes.Buffer // bytes.Buffer.Write() does not return errors
+	title = subjects[0]
+	if len(subjects) == 1 {
+		if lastBody != "" {
+			buf.WriteString(lastBody + "\n\n")
+		}
+	} else {
+		buf.WriteString("Commits:\n")
+		for _, s := range subjects {
+			buf.WriteString("- " + s + "\n")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("Changed files:\n")
+	for _, f := range sortedFiles {
+		buf.WriteString("- `" + f + "`\n")
+	}
+	return title, buf.String(), nil
+}
+
+// mailCommand returns a Cobra command that pushes the current branch and opens
+// a GitHub pull request for it
+func mailCommand() *cobra.Command {
+	var base, title string
+	mail := &cobra.Command{
+		Use:   "mail",
+		Short: "Push this branch and open a GitHub pull request for it",
+		Run: gitBoundedCommand(0, 0, func(args []string) error {
+			client, err := curClient()
+			if err != nil {
+				return err
+			}
+			branch := git.CurBranch
+			if branch == base || branch == "HEAD" {
+				return fmt.Errorf("'svp mail' must be run from a working branch, not "+
+					"%s or a detached HEAD", base)
+			}
+			repo, err := githubRepo("")
+			if err != nil {
+				return err
+			}
+			if uncommitted, err := uncommittedFiles(); err != nil {
+				return err
+			} else if len(uncommitted) > 0 {
+				fmt.Fprintf(os.Stderr, "warning: %d uncommitted file(s) will not be "+
+					"included in the pull request\n", len(uncommitted))
+			}
+
+			// Push the branch ('svp sync' rewrites it, so this may need to force).
+			// git push reports where it pushed (and any messages from the remote)
+			// on stderr, so show that as well
+			op := remoteOp()
+			op.OutputTo(os.Stdout)
+			op.TeeStdErr(os.Stderr)
+			op.Run("git", "push", "--force-with-lease", "--set-upstream", "origin",
+				branch)
+			if err := op.DetailedError(); err != nil {
+				return err
+			}
+
+			// If this client already has an open pull request, pushing updated it
+			info := cachedClient(client)
+			if open := pullRequestOpen(client, git.Root); open != nil && *open {
+				fmt.Printf("updated pull request #%d\n", info.PullRequest)
+				return nil
+			}
+
+			prTitle, prBody, err := pullRequestText(branch, "origin/"+base)
+			if err != nil {
+				return err
+			}
+			if title != "" {
+				prTitle = title
+			}
+			if DryRun {
+				fmt.Printf("# would open pull request in %s: %q\n", repo, prTitle)
+				return nil
+			}
+			pr, err := createPullRequest(repo, branch, base, prTitle, prBody)
+			if err != nil {
+				return err
+			}
+			updateCachedClient(client, func(info *ClientInfo) {
+				open := pr.State == "open"
+				info.PullRequest = pr.Number
+				info.IsPullRequestOpen = &open
+				info.PullRequestCheckedAt = time.Now()
+			})
+			fmt.Printf("opened pull request #%d: %s\n", pr.Number, pr.HTMLURL)
+			return nil
+		}),
+	}
+	mail.Flags().StringVar(&base, "base", "master", "The branch that the pull "+
+		"request should be merged into")
+	mail.Flags().StringVar(&title, "title", "", "The title of the pull request "+
+		"(by default, the subject of the branch's first commit)")
+	return mail
+}
@@ -0,0 +1,251 @@
+package cmds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/svp/config"
+
+	"github.com/spf13/cobra"
+)
+
+// clientStatus is the summary of a client's git repo that is printed by
+// 'svp list-clients'
+type clientStatus struct {
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+
+	// The number of uncommitted files in the client's git repo
+	Dirty int `json:"dirty"`
+
+	// The number of commits in 'Branch' that aren't in origin/master, and vice
+	// versa
+	Ahead  int `json:"ahead"`
+	Behind int `json:"behind"`
+
+	// The most recent modification time of any uncommitted file in the client,
+	// or the time of the client's most recent commit if it's clean
+	LastModified time.Time `json:"last_modified"`
+
+	// Can be true or false, or unset if unknown
+	IsPullRequestOpen *bool `json:"pull_request_open,omitempty"`
+
+	// Set if the status of this client could not be determined
+	Err string `json:"error,omitempty"`
+}
+
+// listClientNames returns the names of all clients in the clients directory
+// (i.e. all directories in it that are valid client names, ignoring .svp)
+func listClientNames() ([]string, error) {
+	infos, err := ioutil.ReadDir(config.Config.ClientDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("could not read clients directory %s: %v",
+			config.Config.ClientDirectory, err)
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") ||
+			!clientMatcher.MatchString(info.Name()) {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+// errFoundRepo stops the search for a client's main repo (see mainRepo())
+var errFoundRepo = errors.New("found a git repo")
+
+// mainRepo returns the path of the git repo whose status 'list-clients'
+// reports for the client at 'clientPath': 'main_repo' in .svpconfig, if the
+// client has it, or otherwise the first git repo found in the client. The
+// search stops at that repo, and skips GOPATH's bin/ and pkg/ directories.
+func mainRepo(clientPath string) (string, error) {
+	if config.Config.MainRepo != "" {
+		repo := path.Join(clientPath, config.Config.MainRepo)
+		if _, err := os.Stat(path.Join(repo, ".git")); err == nil {
+			return repo, nil
+		}
+	}
+	var repo string
+	err := filepath.Walk(clientPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p == path.Join(clientPath, "bin") || p == path.Join(clientPath, "pkg") {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(path.Join(p, ".git")); err == nil {
+			repo = p
+			return errFoundRepo
+		}
+		return nil
+	})
+	if err != nil && err != errFoundRepo {
+		return "", fmt.Errorf("could not search %s for git repos: %v", clientPath,
+			err)
+	}
+	if repo == "" {
+		return "", errors.New("no git repo found in client")
+	}
+	return repo, nil
+}
+
+// getClientStatus computes the status of the client named 'name'. Errors are
+// reported in the result's 'Err' field, so that one broken client doesn't
+// prevent the others from being listed. This doesn't change the working
+// directory, so it's safe to call concurrently
+func getClientStatus(name string) (result clientStatus) {
+	result.Name = name
+	repo, err := mainRepo(path.Join(config.Config.ClientDirectory, name))
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	result.IsPullRequestOpen = pullRequestOpen(name, repo)
+
+	// Get the current branch, and the number of commits that it's ahead of and
+	// behind origin/master
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run("git", "-C", repo, "rev-parse", "--abbrev-ref", "HEAD")
+	result.Branch = strings.TrimSpace(op.Output())
+	op.Run("git", "-C", repo, "rev-parse", "HEAD", "origin/master")
+	commits := strings.Fields(op.Output())
+	op.Run("git", "-C", repo, "log", "-1", "--format=%ct")
+	if ts, err := strconv.ParseInt(strings.TrimSpace(op.Output()), 10, 64); err == nil {
+		result.LastModified = time.Unix(ts, 0)
+	}
+	if err := op.DetailedError(); err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	if len(commits) != 2 {
+		result.Err = fmt.Sprintf("could not parse commits from 'git rev-parse': %q",
+			commits)
+		return result
+	}
+	result.Ahead, result.Behind, err = getClientInfoSlow(name, repo, commits[0],
+		commits[1])
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+
+	// Count uncommitted files, and check if any were modified after the last
+	// commit
+	files, err := uncommittedFilesIn(repo)
+	if err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	result.Dirty = len(files)
+	for file := range files {
+		info, err := os.Stat(path.Join(repo, file))
+		if err == nil && info.ModTime().After(result.LastModified) {
+			result.LastModified = info.ModTime()
+		}
+	}
+	return result
+}
+
+// aheadBehind returns the number of commits in 'head' that aren't in
+// 'upstream' and vice versa, in the git repo at 'repo'
+func aheadBehind(repo, head, upstream string) (ahead, behind int, err error) {
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run("git", "-C", repo, "rev-list", "--left-right", "--count",
+		upstream+"..."+head)
+	if err := op.DetailedError(); err != nil {
+		return 0, 0, err
+	}
+	counts := strings.Fields(op.Output())
+	if len(counts) != 2 {
+		return 0, 0, fmt.Errorf("could not parse output of 'git rev-list': %q",
+			op.Output())
+	}
+	if behind, err = strconv.Atoi(counts[0]); err != nil {
+		return 0, 0, fmt.Errorf("could not parse behind count: %v", err)
+	}
+	if ahead, err = strconv.Atoi(counts[1]); err != nil {
+		return 0, 0, fmt.Errorf("could not parse ahead count: %v", err)
+	}
+	return ahead, behind, nil
+}
+
+// printClientTable prints 'statuses' to stdout as a human-readable table
+func printClientTable(statuses []clientStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tBRANCH\tDIRTY\tAHEAD/BEHIND\tLAST MODIFIED\tPR")
+	for _, s := range statuses {
+		if s.Err != "" {
+			fmt.Fprintf(w, "%s\t(error: %s)\t\t\t\t\n", s.Name,
+				strings.Replace(s.Err, "\n", " ", -1))
+			continue
+		}
+		pr := "?"
+		if s.IsPullRequestOpen != nil {
+			pr = "closed"
+			if *s.IsPullRequestOpen {
+				pr = "open"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t+%d/-%d\t%s\t%s\n", s.Name, s.Branch, s.Dirty,
+			s.Ahead, s.Behind, s.LastModified.Format("2006-01-02 15:04"), pr)
+	}
+	return w.Flush()
+}
+
+// listClients is a Cobra command that prints the status of every client in
+// the pre-configured clients directory
+func listClients() *cobra.Command {
+	var asJSON bool
+	listClientsCmd := &cobra.Command{
+		Use:   "list-clients",
+		Short: "Print the git status of every client",
+		Run: BoundedCommand(0, 0, func(args []string) error {
+			names, err := listClientNames()
+			if err != nil {
+				return err
+			}
+			sort.Strings(names)
+
+			// Get the status of all clients in parallel, as running 'git' serially
+			// in each client is slow
+			statuses := make([]clientStatus, len(names))
+			var wg sync.WaitGroup
+			for i, name := range names {
+				wg.Add(1)
+				go func(i int, name string) {
+					defer wg.Done()
+					statuses[i] = getClientStatus(name)
+				}(i, name)
+			}
+			wg.Wait()
+
+			if asJSON {
+				e := json.NewEncoder(os.Stdout)
+				e.SetIndent("", "  ")
+				return e.Encode(statuses)
+			}
+			return printClientTable(statuses)
+		}),
+	}
+	listClientsCmd.Flags().BoolVar(&asJSON, "json", false, "Print client "+
+		"statuses as JSON instead of a table")
+	return listClientsCmd
+}
@@ -0,0 +1,120 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/config"
+)
+
+// setMainRepo sets 'main_repo' in svp's config for the rest of the test
+func setMainRepo(t *testing.T, repo string) {
+	prev := config.Config.MainRepo
+	config.Config.MainRepo = repo
+	t.Cleanup(func() { config.Config.MainRepo = prev })
+}
+
+func TestMainRepo(t *testing.T) {
+	dir := clientDir(t)
+	client := path.Join(dir, "foo")
+	mkdirs(t, client, "bin/tool/.git", "src/github.com/aaa/x/.git",
+		"src/github.com/aaa/x/vendor/y/.git",
+		"src/github.com/pachyderm/pachyderm/.git")
+
+	// The configured main repo is preferred over lexically earlier repos...
+	setMainRepo(t, "src/github.com/pachyderm/pachyderm")
+	repo, err := mainRepo(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := path.Join(client, "src/github.com/pachyderm/pachyderm")
+	if repo != want {
+		t.Fatalf("expected main repo %s, but got %s", want, repo)
+	}
+
+	// ...and otherwise the first repo is used, skipping bin/
+	for _, setting := range []string{"", "src/github.com/nonexistent"} {
+		setMainRepo(t, setting)
+		repo, err := mainRepo(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := path.Join(client, "src/github.com/aaa/x"); repo != want {
+			t.Fatalf("with main_repo %q: expected main repo %s, but got %s",
+				setting, want, repo)
+		}
+	}
+
+	mkdirs(t, dir, "empty/src")
+	if _, err := mainRepo(path.Join(dir, "empty")); err == nil ||
+		!strings.Contains(err.Error(), "no git repo") {
+		t.Fatalf("expected error for client with no repo, but got %v", err)
+	}
+}
+
+func TestListClientsOutput(t *testing.T) {
+	dir := clientDir(t)
+	setMainRepo(t, "src/github.com/pachyderm/pachyderm")
+	repo := path.Join(dir, "foo/src/github.com/pachyderm/pachyderm")
+	mkdirs(t, repo, ".git")
+
+	// Use a cache with an open PR for "foo", so that it's not looked up
+	open := true
+	useCache(t, map[string]ClientInfo{"foo": {
+		PullRequest:          12,
+		IsPullRequestOpen:    &open,
+		PullRequestCheckedAt: time.Now(),
+	}})
+
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "-C", repo, "rev-parse", "--abbrev-ref", "HEAD").
+		Returns("feat\n")
+	fake.Expect("git", "-C", repo, "rev-parse", "HEAD", "origin/master").
+		Returns("aaaa\nbbbb\n")
+	fake.Expect("git", "-C", repo, "log", "-1", "--format=%ct").
+		Returns("1500000000\n")
+	fake.Expect("git", "-C", repo, "rev-list", "--left-right", "--count",
+		"bbbb...aaaa").Returns("3\t2\n")
+	fake.Expect("git", "status", "--porcelain").InDir(repo).
+		Returns(" M a.go\nA  b.go\n?? notes.txt\n")
+	status := getClientStatus("foo")
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if status.Err != "" {
+		t.Fatalf("unexpected error in status: %s", status.Err)
+	}
+
+	stdout, err := ioutil.TempFile("", "svp-test-stdout-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer func(prev *os.File) { os.Stdout = prev }(os.Stdout)
+	os.Stdout = stdout
+	if err := printClientTable([]clientStatus{status,
+		{Name: "zzz", Err: "no git repo found in client"}}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and two clients, but got:\n%s", output)
+	}
+	want := "foo feat 2 +2/-3 " + time.Unix(1500000000, 0).Format("2006-01-02 15:04") +
+		" open"
+	if got := strings.Join(strings.Fields(lines[1]), " "); got != want {
+		t.Fatalf("expected client row %q, but got %q", want, got)
+	}
+	if !strings.Contains(lines[2], "(error: no git repo found in client)") {
+		t.Fatalf("expected an error row for zzz, but got %q", lines[2])
+	}
+}
@@ -0,0 +1,252 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/msteffen/pachyderm-tools/svp/config"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+
+	"github.com/spf13/cobra"
+)
+
+// curClient returns the name of the client containing the current git repo
+// (i.e. the first path component of git.Root under the clients directory)
+func curClient() (string, error) {
+	rel, err := filepath.Rel(config.Config.ClientDirectory, git.Root)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not inside a client in %s", git.Root,
+			config.Config.ClientDirectory)
+	}
+	client := strings.Split(rel, string(filepath.Separator))[0]
+	if checkClientName(client) != nil {
+		// e.g. a template in .svp/templates
+		return "", fmt.Errorf("%s is not inside a client in %s", git.Root,
+			config.Config.ClientDirectory)
+	}
+	return client, nil
+}
+
+// isAncestor returns true if the commit 'ancestor' is reachable from 'commit'
+// in the current git repo
+func isAncestor(ancestor, commit string) bool {
+	op := queryOp()
+	return op.Run("git", "merge-base", "--is-ancestor", ancestor, commit) == nil
+}
+
+// isMerged returns true if all of the changes in 'branch' are in
+// origin/master, either because 'branch' was merged or fast-forwarded into it,
+// or because it was squashed (in which case every file changed in 'branch'
+// has the same contents in origin/master)
+func isMerged(branch string) (bool, error) {
+	if isAncestor(branch, "origin/master") {
+		return true, nil
+	}
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run("git", "merge-base", branch, "origin/master")
+	if err := op.DetailedError(); err != nil {
+		return false, err
+	}
+	files, err := committedFiles(strings.TrimSpace(op.Output()), branch)
+	if err != nil {
+		return false, err
+	}
+	if len(files) == 0 {
+		return true, nil
+	}
+	args := []string{"git", "diff", "--quiet", branch, "origin/master", "--"}
+	for f := range files {
+		args = append(args, f)
+	}
+	// 'git diff --quiet' exits 1 if there are differences
+	return op.Run(args...) == nil, nil
+}
+
+// submitClient submits the current branch (see submitCommand()) and retires
+// the client containing it, which was created from 'template'
+func submitClient(template string, merge, archive bool) error {
+	client, err := curClient()
+	if err != nil {
+		return err
+	}
+	// Each finished step is recorded in a journal, so that if submit is
+	// interrupted, re-running it skips those steps
+	journal := path.Join(config.Config.ClientDirectory, ".svp/submit",
+		client+".journal")
+	steps := startOp().Journal(journal, os.Stdout)
+	step := func(name string, f func() error) error {
+		if err := steps.StepID(name).Do(func() error {
+			fmt.Printf("[%s]\n", name)
+			return f()
+		}); err != nil {
+			return fmt.Errorf("[%s] failed (re-run to resume from here):\n%w",
+				name, err)
+		}
+		return nil
+	}
+
+	// If a previous run already deleted the local branch, HEAD is detached,
+	// so the branch name must come from the journal
+	if err := steps.StepID("branch").Do(func() error {
+		steps.SetVar("branch", git.CurBranch)
+		return nil
+	}); err != nil {
+		return err
+	}
+	branch, _ := steps.Var("branch")
+	if branch == "master" || branch == "HEAD" {
+		steps.DiscardJournal()
+		return fmt.Errorf("'svp submit' must be run from a working branch, " +
+			"not master or a detached HEAD")
+	}
+	if git.CurBranch != "HEAD" && git.CurBranch != branch {
+		return fmt.Errorf("a previous 'svp submit' of %s in this client didn't "+
+			"finish; check out %s to resume it, or delete %s to start over",
+			branch, branch, journal)
+	}
+
+	if err := step("check", func() error {
+		uncommitted, err := uncommittedFiles()
+		if err != nil {
+			return err
+		}
+		if len(uncommitted) > 0 {
+			return fmt.Errorf("%s has uncommitted changes; commit or stash them",
+				client)
+		}
+		// Make sure that nothing else in the client (e.g. untracked files, other
+		// branches or stashes) will be lost, before anything is pushed or deleted
+		if !archive {
+			if err := confirmNoUnsavedWork(client, git.Root, branch); err != nil {
+				return err
+			}
+		}
+		op := remoteOp()
+		op.RunWithRetry(gitRetry, "git", "fetch", "origin")
+		if err := op.DetailedError(); err != nil {
+			return err
+		}
+		if !isAncestor("origin/master", branch) {
+			return fmt.Errorf("%s is not rebased on origin/master; run "+
+				"'svp sync' first", branch)
+		}
+		return nil
+	}); err != nil {
+		// Nothing has changed yet, so start over (possibly from a different
+		// branch) next time
+		steps.DiscardJournal()
+		return err
+	}
+
+	if err := step("push", func() error {
+		op := remoteOp()
+		op.OutputTo(os.Stdout)
+		op.TeeStdErr(os.Stderr) // git push reports its progress on stderr
+		op.Run("git", "push", "--force-with-lease", "origin", branch)
+		return op.DetailedError()
+	}); err != nil {
+		return err
+	}
+
+	if err := step("merge", func() error {
+		op := remoteOp()
+		op.OutputTo(os.Stdout)
+		if merge {
+			// Fast-forward origin's master to 'branch' (which is rebased on it)
+			op.Run("git", "push", "origin", branch+":master")
+			return op.DetailedError()
+		}
+		if open := pullRequestOpen(client, git.Root); open != nil && *open {
+			return fmt.Errorf("the pull request for %s is still open", branch)
+		}
+		op.RunWithRetry(gitRetry, "git", "fetch", "origin")
+		if err := op.DetailedError(); err != nil {
+			return err
+		}
+		merged, err := isMerged(branch)
+		if err != nil {
+			return err
+		}
+		if !merged {
+			return fmt.Errorf("%s has not been merged into origin/master; "+
+				"merge its pull request (or use --merge)", branch)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := step("delete-remote-branch", func() error {
+		op := remoteOp()
+		op.OutputTo(os.Stdout)
+		op.Run("git", "push", "origin", "--delete", branch)
+		if op.LastError() != nil &&
+			strings.Contains(string(op.LastErrorMsg()), "remote ref does not exist") {
+			return nil // already deleted (e.g. by GitHub)
+		}
+		return op.DetailedError()
+	}); err != nil {
+		return err
+	}
+
+	if err := step("delete-local-branch", func() error {
+		op := startOp()
+		op.OutputTo(os.Stdout)
+		op.Run("git", "checkout", "--quiet", "--detach", "origin/master")
+		op.Run("git", "branch", "-D", branch)
+		return op.DetailedError()
+	}); err != nil {
+		return err
+	}
+
+	if err := step("retire-client", func() error {
+		archiveDir := ""
+		if archive {
+			archiveDir = path.Join(config.Config.ClientDirectory, ".svp/archive")
+		}
+		return removeClient(client, template, archiveDir)
+	}); err != nil {
+		return err
+	}
+
+	// The client is gone, so its journal is no longer needed
+	if err := steps.DiscardJournal(); err != nil {
+		return err
+	}
+	if DryRun {
+		return nil
+	}
+	fmt.Printf("submitted %s and retired client %s\n", branch, client)
+	return nil
+}
+
+// submitCommand returns a Cobra command that merges the current client's
+// branch and retires the client
+func submitCommand() *cobra.Command {
+	var merge, archive bool
+	var template string
+	submit := &cobra.Command{
+		Use:   "submit",
+		Short: "Merge this client's branch, delete it, and delete the client",
+		Long: "Push this client's branch, and either merge it into master " +
+			"(--merge) or confirm that its pull request has been merged. Then " +
+			"delete the branch locally and in origin, and delete (or archive) the " +
+			"client. Each finished step is logged, so if submit is interrupted, " +
+			"re-running it resumes where it left off.",
+		Run: gitBoundedCommand(0, 0, func(args []string) error {
+			return submitClient(resolveTemplate(template), merge, archive)
+		}),
+	}
+	submit.Flags().BoolVarP(&merge, "merge", "m", false, "Merge the branch "+
+		"into origin/master directly, instead of waiting for its pull request "+
+		"to be merged")
+	submit.Flags().BoolVarP(&archive, "archive", "a", false, "Move the client "+
+		"into ClientDirectory/.svp/archive instead of deleting it")
+	submit.Flags().StringVarP(&template, "template", "t", "", "The template "+
+		"that the client was created from (used to find its teardown script)")
+	return submit
+}
@@ -0,0 +1,112 @@
+package cmds
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+)
+
+// submitClientDir creates the client "foo" (containing one git repo, which
+// is on the branch 'branch') in a new clients directory, and makes that repo
+// the current one for the rest of the test. It returns the clients directory
+// and the repo.
+func submitClientDir(t *testing.T, branch string) (dir, repo string) {
+	dir = clientDir(t)
+	repo = path.Join(dir, "foo/src/github.com/x/y")
+	mkdirs(t, repo, ".git")
+	prevRoot, prevBranch := git.Root, git.CurBranch
+	git.Root, git.CurBranch = repo, branch
+	t.Cleanup(func() { git.Root, git.CurBranch = prevRoot, prevBranch })
+	return dir, repo
+}
+
+// expectSubmitCheck adds the commands run by submit's "check" step (for the
+// branch 'branch' of 'repo') to 'fake'
+func expectSubmitCheck(fake *op.FakeExecutor, repo, branch string) {
+	fake.Expect("git", "status", "--porcelain")
+	fake.Expect("git", "status", "--porcelain").InDir(repo)
+	fake.Expect("git", "log", "--branches", "--not", "--remotes", "--oneline",
+		"refs/heads/"+branch).InDir(repo)
+	fake.Expect("git", "stash", "list").InDir(repo)
+	fake.Expect("git", "fetch", "origin")
+	fake.Expect("git", "merge-base", "--is-ancestor", "origin/master", branch)
+}
+
+func TestSubmitResume(t *testing.T) {
+	dir, repo := submitClientDir(t, "feat")
+	journal := path.Join(dir, ".svp/submit/foo.journal")
+
+	// First run: the push fails after the check succeeded
+	fake := op.UseFakeExecutor(t)
+	expectSubmitCheck(fake, repo, "feat")
+	fake.Expect("git", "push", "--force-with-lease", "origin", "feat").
+		Fails(1, "error: failed to push some refs")
+	if err := submitClient("tmpl", true, false); err == nil ||
+		!strings.Contains(err.Error(), "[push] failed") {
+		t.Fatalf("expected the push step to fail, but got %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second run: the check is skipped, and the remaining steps run in order
+	fake = op.UseFakeExecutor(t)
+	fake.Expect("git", "push", "--force-with-lease", "origin", "feat")
+	fake.Expect("git", "push", "origin", "feat:master")
+	fake.Expect("git", "push", "origin", "--delete", "feat")
+	fake.Expect("git", "checkout", "--quiet", "--detach", "origin/master")
+	fake.Expect("git", "branch", "-D", "feat")
+	fake.Expect("rm", "-rf", path.Join(dir, "foo")).InDir(dir)
+	if err := submitClient("tmpl", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatalf("expected journal to be removed, but got %v", err)
+	}
+}
+
+func TestSubmitCheckFails(t *testing.T) {
+	_, repo := submitClientDir(t, "feat")
+
+	// The check fails, so nothing is journaled...
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "status", "--porcelain").Returns(" M main.go\n")
+	if err := submitClient("tmpl", true, false); err == nil ||
+		!strings.Contains(err.Error(), "uncommitted changes") {
+		t.Fatalf("expected the check to fail, but got %v", err)
+	}
+
+	// ...and a later submit from a different branch submits that branch
+	git.CurBranch = "other"
+	expectSubmitCheck(fake, repo, "other")
+	fake.Expect("git", "push", "--force-with-lease", "origin", "other").
+		Fails(1, "error: failed to push some refs")
+	if err := submitClient("tmpl", true, false); err == nil ||
+		!strings.Contains(err.Error(), "[push] failed") {
+		t.Fatalf("expected the push step to fail, but got %v", err)
+	}
+}
+
+func TestSubmitOtherBranch(t *testing.T) {
+	_, repo := submitClientDir(t, "feat")
+
+	fake := op.UseFakeExecutor(t)
+	expectSubmitCheck(fake, repo, "feat")
+	fake.Expect("git", "push", "--force-with-lease", "origin", "feat").
+		Fails(1, "error: failed to push some refs")
+	if err := submitClient("tmpl", true, false); err == nil {
+		t.Fatal("expected the push step to fail")
+	}
+
+	// The unfinished submit is of 'feat', so submitting 'other' must not
+	// resume it (and run nothing)
+	git.CurBranch = "other"
+	if err := submitClient("tmpl", true, false); err == nil ||
+		!strings.Contains(err.Error(), "check out feat") {
+		t.Fatalf("expected submit from another branch to fail, but got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+
+	"github.com/spf13/cobra"
+)
+
+// stashMsg is the message attached to the stash created by 'svp sync', so
+// that users can recognize it in 'git stash list' if sync is interrupted
+const stashMsg = "svp sync: auto-stash"
+
+// fetchTimeout is how long 'git fetch' may run before svp gives up on it
+// (e.g. if the network is down)
+const fetchTimeout = 5 * time.Minute
+
+// conflictingFiles returns the files in the current git repo that have
+// unresolved merge conflicts
+func conflictingFiles() ([]string, error) {
+	op := queryOp()
+	op.CollectStdOut()
+	op.Run("git", "diff", "--name-only", "--diff-filter=U")
+	if err := op.DetailedError(); err != nil {
+		return nil, err
+	}
+	return strings.Fields(op.Output()), nil
+}
+
+// conflictError returns an error describing a failed rebase or stash pop. If
+// the failure left files with unresolved conflicts, the error lists them along
+// with 'hint', which should tell the user how to finish. Otherwise (e.g. the
+// command failed for some other reason) it includes 'otherHint' instead.
+func conflictError(cause error, hint, otherHint string) error {
+	files, err := conflictingFiles()
+	if err != nil || len(files) == 0 {
+		return fmt.Errorf("%w\n%s", cause, strings.TrimSpace(otherHint))
+	}
+	return fmt.Errorf("%w\nconflicting files:\n  %s\n%s", cause,
+		strings.Join(files, "\n  "), hint)
+}
+
+// hasLocalChanges returns true if the current git repo has uncommitted
+// changes to tracked files, which would prevent 'git rebase' from running.
+// Unlike uncommittedFiles(), it includes the files that svp modifies in every
+// client, as git doesn't skip them either.
+func hasLocalChanges() (bool, error) {
+	op := queryOp()
+	op.CollectStdOut()
+	op.RunWithRetry(gitRetry, "git", "status", "--porcelain",
+		"--untracked-files=no")
+	if err := op.DetailedError(); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(op.Output()) != "", nil
+}
+
+// latestStash returns the commit ID of the newest stash in the current git
+// repo, or "" if there are no stashes
+func latestStash() (string, error) {
+	query := queryOp()
+	query.CollectStdOut()
+	// 'git rev-parse --verify -q' exits 1 without printing anything if the ref
+	// doesn't exist
+	if err := query.Run("git", "rev-parse", "--verify", "-q", "refs/stash"); err != nil {
+		var opErr *op.Error
+		if errors.As(query.DetailedError(), &opErr) && opErr.ExitCode == 1 {
+			return "", nil
+		}
+		return "", query.DetailedError()
+	}
+	return strings.TrimSpace(query.Output()), nil
+}
+
+// squash squashes all commits in the current branch that aren't in 'base'
+// into a single commit, whose message is the concatenation of the squashed
+// commits' messages. It does nothing if there's only one such commit.
+func squash(base string) error {
+	query := queryOp().ExpandVars()
+	query.Capture("base").Run("git", "merge-base", "HEAD", base)
+	query.Capture("count").Run("git", "rev-list", "--count", "{{base}}..HEAD")
+	count, _ := query.Var("count")
+	if query.LastError() != nil || count == "0" || count == "1" {
+		return query.DetailedError()
+	}
+	query.Capture("msg").Run("git", "log", "--reverse", "--format=%B",
+		"{{base}}..HEAD")
+	if err := query.DetailedError(); err != nil {
+		return err
+	}
+	mergeBase, _ := query.Var("base")
+	msg, _ := query.Var("msg")
+	fmt.Printf("squashing %s commits onto %s\n", count, mergeBase)
+	op := startOp()
+	op.OutputTo(os.Stdout)
+	op.Run("git", "reset", "--soft", mergeBase)
+	op.InputFrom(strings.NewReader(msg))
+	op.Run("git", "commit", "--quiet", "-F", "-")
+	return op.DetailedError()
+}
+
+// syncBranch brings the current branch up to date with origin/master (see
+// syncCommand()), first squashing its commits if 'squashFirst' is set
+func syncBranch(squashFirst bool) error {
+	// Stash uncommitted changes, so that rebasing doesn't fail. 'git stash
+	// push' does nothing (and succeeds) if there turn out to be no changes to
+	// stash, so compare refs/stash before and after to see if it created a
+	// stash, and never pop an older, unrelated one
+	dirty, err := hasLocalChanges()
+	if err != nil {
+		return err
+	}
+	stashed := false
+	op := remoteOp()
+	op.OutputTo(os.Stdout)
+	if dirty {
+		before, err := latestStash()
+		if err != nil {
+			return err
+		}
+		op.Run("git", "stash", "push", "--message", stashMsg)
+		if err := op.DetailedError(); err != nil {
+			return err
+		}
+		after, err := latestStash()
+		if err != nil {
+			return err
+		}
+		// In dry-run mode nothing is stashed, but print the 'git stash pop'
+		// that would follow
+		stashed = after != before || DryRun
+	}
+	stashHint := ""
+	if stashed {
+		stashHint = fmt.Sprintf(" Your uncommitted changes are saved in the "+
+			"stash \"%s\"; restore them with 'git stash pop'.", stashMsg)
+	}
+
+	// Squash the branch's commits before master moves, so that the merge
+	// base is still correct and conflicts only need to be resolved once
+	if squashFirst && git.CurBranch != "master" {
+		if err := squash("master"); err != nil {
+			return fmt.Errorf("could not squash commits:\n%w\n%s", err,
+				strings.TrimSpace(stashHint))
+		}
+	}
+
+	// Fetch origin and fast-forward local master. When master isn't checked
+	// out, fetching from the local repo updates it without a checkout (and
+	// refuses anything but a fast-forward)
+	op.Timeout(fetchTimeout)
+	op.RunWithRetry(gitRetry, "git", "fetch", "origin")
+	op.Timeout(0)
+	if git.CurBranch == "master" {
+		op.Run("git", "merge", "--ff-only", "origin/master")
+	} else {
+		op.RunWithRetry(gitRetry, "git", "fetch", ".", "origin/master:master")
+	}
+	if err := op.DetailedError(); err != nil {
+		return fmt.Errorf("%w\n%s", err, strings.TrimSpace(stashHint))
+	}
+
+	// Rebase the current branch
+	if git.CurBranch != "master" {
+		if err := op.Run("git", "rebase", "master"); err != nil {
+			return conflictError(op.DetailedError(), "Resolve the conflicts "+
+				"and run 'git rebase --continue' (or 'git rebase --abort')."+
+				stashHint, stashHint)
+		}
+	}
+
+	// Restore uncommitted changes
+	if stashed {
+		if err := op.Run("git", "stash", "pop"); err != nil {
+			return conflictError(op.DetailedError(), "Resolve the conflicts; "+
+				"your changes are still in the stash, so run 'git stash drop' "+
+				"once they're resolved.", "Your changes are still in the stash "+
+				"\""+stashMsg+"\"; restore them with 'git stash pop'.")
+		}
+	}
+	return nil
+}
+
+// syncCommand returns a Cobra command that brings the current branch up to
+// date with origin/master
+func syncCommand() *cobra.Command {
+	var squashFirst bool
+	sync := &cobra.Command{
+		Use:   "sync",
+		Short: "Update master from origin and rebase the current branch onto it",
+		Long: "Fetch origin, fast-forward the local master branch to " +
+			"origin/master, and rebase the current branch onto it. Uncommitted " +
+			"changes are stashed before syncing and restored afterwards.",
+		Run: gitBoundedCommand(0, 0, func(args []string) error {
+			return syncBranch(squashFirst)
+		}),
+	}
+	sync.Flags().BoolVarP(&squashFirst, "squash", "s", false, "Squash all "+
+		"commits in the current branch into one before rebasing, so that "+
+		"conflicts only have to be resolved once")
+	return sync
+}
@@ -0,0 +1,123 @@
+package cmds
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+	"github.com/msteffen/pachyderm-tools/svp/git"
+)
+
+func TestSyncBranch(t *testing.T) {
+	defer func(prev string) { git.CurBranch = prev }(git.CurBranch)
+	status := []string{"git", "status", "--porcelain", "--untracked-files=no"}
+	stash := []string{"git", "rev-parse", "--verify", "-q", "refs/stash"}
+	push := []string{"git", "stash", "push", "--message", stashMsg}
+	conflicts := []string{"git", "diff", "--name-only", "--diff-filter=U"}
+	fetch := func(fake *op.FakeExecutor) {
+		fake.Expect("git", "fetch", "origin")
+		fake.Expect("git", "fetch", ".", "origin/master:master")
+	}
+	for _, c := range []struct {
+		name   string
+		branch string
+		expect func(fake *op.FakeExecutor)
+		errs   []string // substrings of the expected error, if any
+	}{{
+		name:   "clean",
+		branch: "feat",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...)
+			fetch(fake)
+			fake.Expect("git", "rebase", "master")
+		},
+	}, {
+		name:   "clean master",
+		branch: "master",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...)
+			fake.Expect("git", "fetch", "origin")
+			fake.Expect("git", "merge", "--ff-only", "origin/master")
+		},
+	}, {
+		name:   "dirty",
+		branch: "feat",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...).Returns(" M a.go\n")
+			fake.Expect(stash...).Fails(1, "")
+			fake.Expect(push...)
+			fake.Expect(stash...).Returns("1111\n")
+			fetch(fake)
+			fake.Expect("git", "rebase", "master")
+			fake.Expect("git", "stash", "pop")
+		},
+	}, {
+		// 'git stash push' created nothing, so the older stash isn't popped
+		name:   "dirty, nothing stashed",
+		branch: "feat",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...).Returns(" M a.go\n")
+			fake.Expect(stash...).Returns("0000\n")
+			fake.Expect(push...)
+			fake.Expect(stash...).Returns("0000\n")
+			fetch(fake)
+			fake.Expect("git", "rebase", "master")
+		},
+	}, {
+		name:   "rebase conflict",
+		branch: "feat",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...).Returns(" M a.go\n")
+			fake.Expect(stash...).Fails(1, "")
+			fake.Expect(push...)
+			fake.Expect(stash...).Returns("1111\n")
+			fetch(fake)
+			fake.Expect("git", "rebase", "master").Fails(1, "CONFLICT (content)")
+			fake.Expect(conflicts...).Returns("a.go\nb.go\n")
+		},
+		errs: []string{"conflicting files:\n  a.go\n  b.go\n",
+			"git rebase --continue", "restore them with 'git stash pop'"},
+	}, {
+		name:   "rebase fails without conflicts",
+		branch: "feat",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...)
+			fetch(fake)
+			fake.Expect("git", "rebase", "master").Fails(128, "fatal: bad object")
+			fake.Expect(conflicts...)
+		},
+		errs: []string{"fatal: bad object"},
+	}, {
+		name:   "stash pop conflict",
+		branch: "feat",
+		expect: func(fake *op.FakeExecutor) {
+			fake.Expect(status...).Returns(" M a.go\n")
+			fake.Expect(stash...).Fails(1, "")
+			fake.Expect(push...)
+			fake.Expect(stash...).Returns("1111\n")
+			fetch(fake)
+			fake.Expect("git", "rebase", "master")
+			fake.Expect("git", "stash", "pop").Fails(1, "CONFLICT (content)")
+			fake.Expect(conflicts...).Returns("a.go\n")
+		},
+		errs: []string{"conflicting files:\n  a.go\n", "git stash drop"},
+	}} {
+		git.CurBranch = c.branch
+		fake := op.UseFakeExecutor(t)
+		c.expect(fake)
+		err := syncBranch(false)
+		if len(c.errs) == 0 && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if len(c.errs) > 0 && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		for _, want := range c.errs {
+			if err != nil && !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected %q in error, but got:\n%v", c.name, want, err)
+			}
+		}
+		if err := fake.Verify(); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
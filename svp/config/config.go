@@ -26,11 +26,43 @@ var Config struct {
 	// The top-level directory containing all clients
 	ClientDirectory string `json:"client_directory"`
 
-	// The user's preferred tool for diffing branches
+	// The user's preferred tool for diffing branches (deprecated: use
+	// "diff": {"tool": ...}, which takes precedence)
 	DiffTool string `json:"diff_tool"`
 
+	// Settings for 'svp diff' and 'svp changed'. Each of these can be
+	// overridden with the command's flags
+	Diff struct {
+		// A regex matching files that should be skipped (e.g. vendored files)
+		Skip string `json:"skip"`
+
+		// The tool used to view diffs ("meld" or "vim")
+		Tool string `json:"tool"`
+
+		// The branch that changes are computed relative to
+		Branch string `json:"branch"`
+	} `json:"diff"`
+
 	// The default template if 'new-client' is called with no template
 	DefaultTemplate string `json:"default_template"`
+
+	// The path (relative to each client) of the git repo whose status
+	// 'list-clients' reports, e.g. "src/github.com/pachyderm/pachyderm"
+	MainRepo string `json:"main_repo"`
+
+	// Settings for GitHub's API (used by e.g. 'svp mail' to open pull requests)
+	GitHub struct {
+		// The base URL of GitHub's REST API
+		APIURL string `json:"api_url"`
+
+		// The token used to authenticate with GitHub. If unset, svp uses
+		// $GITHUB_TOKEN
+		Token string `json:"token"`
+
+		// The repo that pull requests are opened against, as "owner/name". If
+		// unset, it's inferred from the URL of the 'origin' remote
+		Repo string `json:"repo"`
+	} `json:"github"`
 }
 
 func configPath() string {
@@ -47,11 +79,10 @@ func configPath() string {
 // Config directly
 func InitConfig() {
 	configOnce.Do(func() {
+		loadDefaultConfig()
 		p := configPath()
 		// Parse config and initialize Config fields
-		if _, err := os.Stat(p); os.IsNotExist(err) {
-			loadDefaultConfig()
-		} else {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
 			cfg, err := ioutil.ReadFile(p)
 			if err != nil {
 				log.Fatalf("could not read contents of config file at %s: %v",
@@ -71,4 +102,6 @@ func init() {
 func loadDefaultConfig() {
 	Config.ClientDirectory = path.Join(os.Getenv("HOME"), "clients")
 	Config.DiffTool = "meld"
+	Config.MainRepo = "src/github.com/pachyderm/pachyderm"
+	Config.GitHub.APIURL = "https://api.github.com"
 }
@@ -0,0 +1,28 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/msteffen/pachyderm-tools/op"
+)
+
+func TestInitRoot(t *testing.T) {
+	defer func(prev string) { Root = prev }(Root)
+	fake := op.UseFakeExecutor(t)
+	fake.Expect("git", "rev-parse", "--show-toplevel").Returns("/home/me/repo\n")
+	fake.Expect("git", "rev-parse", "--show-toplevel").Fails(128,
+		"fatal: not a git repository (or any of the parent directories): .git\n")
+	fake.Expect("git", "rev-parse", "--show-toplevel").Fails(1, "disk on fire\n")
+
+	if err := initRoot(); err != nil || Root != "/home/me/repo" {
+		t.Fatalf("expected Root to be /home/me/repo, but got %q (err: %v)", Root,
+			err)
+	}
+	if err := initRoot(); err != nil || Root != "" {
+		t.Fatalf("expected Root to be empty outside of a git repo, but got %q "+
+			"(err: %v)", Root, err)
+	}
+	if err := initRoot(); err == nil {
+		t.Fatal("expected 'git rev-parse' failure to be returned, but got nil")
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"log"
+	"os"
+	"path"
+
 	"github.com/msteffen/pachyderm-tools/svp/cmds"
 
 	"github.com/spf13/cobra"
@@ -13,6 +17,12 @@ func RootCmd() *cobra.Command {
 	root := &cobra.Command{
 		Use: "svp <command>",
 	}
+	root.PersistentFlags().BoolVarP(&cmds.DryRun, "dry-run", "n", false,
+		"Print the commands that svp would run, instead of running them")
+	root.PersistentFlags().BoolVarP(&cmds.Verbose, "verbose", "v", false,
+		"Print each command that svp runs, with its exit code and duration")
+	root.PersistentFlags().BoolVar(&cmds.Timings, "timings", false,
+		"Print the time and memory used by each command that svp runs")
 	for _, cmd := range cmds.GitHelperCommands() {
 		root.AddCommand(cmd)
 	}
@@ -23,5 +33,9 @@ func RootCmd() *cobra.Command {
 }
 
 func main() {
+	cmds.TranscriptDir = path.Join(os.Getenv("HOME"), ".svp/logs")
 	RootCmd().Execute()
+	if err := cmds.WriteCache(); err != nil {
+		log.Printf("could not write svp cache: %v", err)
+	}
 }